@@ -0,0 +1,88 @@
+package genevahttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNoWorkingStrategy is returned by AutoSelectStrategy when none of the candidate strategies
+// could be used to connect, and by DialContext when neither DialerOpts.AlgenevaStrategy nor any of
+// DialerOpts.FallbackStrategies could.
+var ErrNoWorkingStrategy = errors.New("no working strategy found")
+
+// AutoSelectStrategy concurrently dials address on network once with each of the candidate
+// strategies and returns the strategy whose dial completed the fastest. network must be "tcp",
+// "tcp4", or "tcp6", as with DialContext. Each dial uses opts with opts.AlgenevaStrategy set to the
+// candidate and is limited to timeout; if timeout is zero, each dial is only limited by ctx. The
+// connections are closed before AutoSelectStrategy returns. If none of the candidates succeed, an
+// error wrapping ErrNoWorkingStrategy and each dial error is returned.
+func AutoSelectStrategy(
+	ctx context.Context,
+	network, address string,
+	candidates []string,
+	timeout time.Duration,
+	opts DialerOpts,
+) (string, error) {
+	network, err := validateNetwork(network)
+	if err != nil {
+		return "", err
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("%w: no candidates", ErrNoWorkingStrategy)
+	}
+
+	type result struct {
+		strategy string
+		latency  time.Duration
+		err      error
+	}
+	clk := opts.getClock()
+	results := make(chan result, len(candidates))
+	for _, strategy := range candidates {
+		go func(strategy string) {
+			dctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			if timeout > 0 {
+				t := clk.AfterFunc(timeout, cancel)
+				defer t.Stop()
+			}
+
+			o := opts
+			o.AlgenevaStrategy = strategy
+			o.AlgenevaStrategies = nil
+			o.FallbackStrategies = nil
+
+			start := clk.Now()
+			c, err := DialContext(dctx, network, address, o)
+			if err != nil {
+				results <- result{strategy: strategy, err: fmt.Errorf("%s: %w", strategy, err)}
+				return
+			}
+
+			results <- result{strategy: strategy, latency: clk.Since(start)}
+			c.Close()
+		}(strategy)
+	}
+
+	var (
+		best result
+		errs []error
+	)
+	for range candidates {
+		r := <-results
+		switch {
+		case r.err != nil:
+			errs = append(errs, r.err)
+		case best.strategy == "" || r.latency < best.latency:
+			best = r
+		}
+	}
+
+	if best.strategy == "" {
+		return "", fmt.Errorf("%w: %w", ErrNoWorkingStrategy, errors.Join(errs...))
+	}
+
+	return best.strategy, nil
+}
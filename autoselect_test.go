@@ -0,0 +1,93 @@
+package genevahttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/algeneva"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoSelectStrategy(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	go acceptAndClose(ll)
+
+	var (
+		// slow replaces the method with "HTTP/1.1". We delay it in OnTransform to simulate a
+		// slower path.
+		slow = testStrategy(t, "China", 17)
+		fast = testStrategy(t, "China", 0)
+		// noop never matches the request, so it fails with RequireTransform set.
+		noop    = "[HTTP:method:PATCH]-insert{%20:end:value:1}-|"
+		invalid = "not a strategy"
+	)
+	opts := DialerOpts{
+		RequireTransform: true,
+		OnTransform: func(ctx context.Context, req, transformed []byte) {
+			if bytes.HasPrefix(transformed, []byte("HTTP/1.1 ")) {
+				time.Sleep(200 * time.Millisecond)
+			}
+		},
+	}
+
+	ctx := context.Background()
+	got, err := AutoSelectStrategy(ctx, "tcp", l.Addr().String(), []string{slow, invalid, fast, noop}, time.Second, opts)
+	require.NoError(t, err)
+	assert.Equal(t, fast, got)
+
+	_, err = AutoSelectStrategy(ctx, "tcp", l.Addr().String(), []string{invalid, noop}, time.Second, opts)
+	assert.ErrorIs(t, err, ErrNoWorkingStrategy)
+	assert.ErrorIs(t, err, ErrTransformNoOp)
+
+	got, err = AutoSelectStrategy(ctx, "tcp4", l.Addr().String(), []string{fast}, time.Second, opts)
+	require.NoError(t, err)
+	assert.Equal(t, fast, got)
+
+	_, err = AutoSelectStrategy(ctx, "udp", l.Addr().String(), []string{fast}, time.Second, opts)
+	assert.ErrorIs(t, err, ErrUnsupportedNetwork)
+}
+
+// blockingDialer is a Dialer that blocks until the context is done.
+type blockingDialer struct{}
+
+func (blockingDialer) Dial(network, addr string) (net.Conn, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (blockingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestAutoSelectStrategyTimeout(t *testing.T) {
+	clk := newFakeClock()
+	opts := DialerOpts{Dialer: blockingDialer{}, clock: clk}
+	candidates := algeneva.Strategies["China"][:2]
+
+	errC := make(chan error)
+	go func() {
+		_, err := AutoSelectStrategy(context.Background(), "tcp", "example.com:80", candidates, time.Minute, opts)
+		errC <- err
+	}()
+
+	// Wait for each candidate's timer to be created before advancing the clock.
+	clk.waitForTimers(len(candidates))
+	clk.Advance(time.Minute)
+
+	select {
+	case err := <-errC:
+		assert.ErrorIs(t, err, ErrNoWorkingStrategy)
+	case <-time.After(5 * time.Second):
+		t.Fatal("AutoSelectStrategy did not time out")
+	}
+}
@@ -0,0 +1,77 @@
+package genevahttp
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// normalizationBufferSize is the capacity of each buffer in a fixedBufferPool. It's large enough
+// for the request-line and headers of a typical websocket upgrade request.
+const normalizationBufferSize = 4096
+
+// bufferPool provides the buffers normalizationConn uses to read and normalize the first request.
+type bufferPool interface {
+	// get returns an empty buffer. If the pool has to wait for a buffer to be free, it returns
+	// ctx's error if ctx is done first.
+	get(ctx context.Context) (*bytes.Buffer, error)
+	// put returns buf to the pool once it's no longer used.
+	put(buf *bytes.Buffer)
+}
+
+// syncBufferPool is a bufferPool backed by a sync.Pool. Buffers are reused across connections, but
+// the number of buffers, and so the memory used, is unbounded.
+type syncBufferPool struct {
+	pool sync.Pool
+}
+
+func newSyncBufferPool() *syncBufferPool {
+	return &syncBufferPool{
+		pool: sync.Pool{New: func() any { return &bytes.Buffer{} }},
+	}
+}
+
+func (p *syncBufferPool) get(context.Context) (*bytes.Buffer, error) {
+	return p.pool.Get().(*bytes.Buffer), nil
+}
+
+func (p *syncBufferPool) put(buf *bytes.Buffer) {
+	buf.Reset()
+	p.pool.Put(buf)
+}
+
+// fixedBufferPool is a bufferPool with a fixed number of buffers. get blocks until a buffer is
+// free, so the memory used for normalization is bounded no matter how many connections there are.
+type fixedBufferPool struct {
+	bufs chan *bytes.Buffer
+	// size is the capacity of each buffer. Buffers that grow beyond it are replaced when returned
+	// so the pool doesn't retain memory from unusually large requests.
+	size int
+}
+
+func newFixedBufferPool(n, size int) *fixedBufferPool {
+	p := &fixedBufferPool{bufs: make(chan *bytes.Buffer, n), size: size}
+	for i := 0; i < n; i++ {
+		p.bufs <- bytes.NewBuffer(make([]byte, 0, size))
+	}
+
+	return p
+}
+
+func (p *fixedBufferPool) get(ctx context.Context) (*bytes.Buffer, error) {
+	select {
+	case buf := <-p.bufs:
+		return buf, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *fixedBufferPool) put(buf *bytes.Buffer) {
+	if buf.Cap() > p.size {
+		buf = bytes.NewBuffer(make([]byte, 0, p.size))
+	}
+
+	buf.Reset()
+	p.bufs <- buf
+}
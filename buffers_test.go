@@ -0,0 +1,164 @@
+package genevahttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readerConn is a net.Conn that reads from r.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *readerConn) Close() error               { return nil }
+
+const testRequest = "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n"
+
+func TestFixedBufferPool(t *testing.T) {
+	p := newFixedBufferPool(1, 16)
+	buf, err := p.get(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, p.bufs, "pool should be exhausted")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = p.get(ctx)
+	assert.ErrorIs(t, err, context.Canceled, "get should give up once ctx is done")
+
+	buf.Write(bytes.Repeat([]byte("a"), 64))
+	p.put(buf)
+	buf, err = p.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, buf.Len())
+	assert.Equal(t, 16, buf.Cap(), "oversized buffers should be replaced")
+}
+
+func TestNormalizationConnReleasesBuffer(t *testing.T) {
+	p := newFixedBufferPool(1, normalizationBufferSize)
+
+	t.Run("drained", func(t *testing.T) {
+		nc := &normalizationConn{Conn: &readerConn{r: bytes.NewReader([]byte(testRequest))}, buffers: p}
+		got, err := io.ReadAll(nc)
+		require.NoError(t, err)
+		assert.Equal(t, testRequest, string(got))
+		assert.Len(t, p.bufs, 1, "buffer should be released once drained")
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		nc := &normalizationConn{Conn: &readerConn{r: bytes.NewReader([]byte(testRequest))}, buffers: p}
+		_, err := nc.Read(make([]byte, 1))
+		require.NoError(t, err)
+		assert.Empty(t, p.bufs)
+
+		require.NoError(t, nc.Close())
+		assert.Len(t, p.bufs, 1, "buffer should be released on close")
+	})
+
+	t.Run("error", func(t *testing.T) {
+		nc := &normalizationConn{Conn: &readerConn{r: bytes.NewReader([]byte("GET"))}, buffers: p}
+		_, err := nc.Read(make([]byte, 1))
+		require.Error(t, err)
+		assert.Len(t, p.bufs, 1, "buffer should be released on error")
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		nc := &normalizationConn{
+			Conn:      &readerConn{r: bytes.NewReader([]byte(testRequest))},
+			buffers:   p,
+			normalize: func(req []byte) ([]byte, error) { panic("malformed request") },
+		}
+		assert.Panics(t, func() { nc.Read(make([]byte, 1)) })
+		assert.Len(t, p.bufs, 1, "buffer should be released on panic")
+	})
+}
+
+func TestNormalizationConnBufferWait(t *testing.T) {
+	p := newFixedBufferPool(1, normalizationBufferSize)
+	held, err := p.get(context.Background())
+	require.NoError(t, err)
+	defer p.put(held)
+
+	t.Run("first request timeout", func(t *testing.T) {
+		c, _ := net.Pipe()
+		defer c.Close()
+
+		nc := &normalizationConn{Conn: c, buffers: p, firstRequestTimeout: 50 * time.Millisecond}
+		_, err := nc.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, ErrFirstRequestTimeout)
+	})
+
+	t.Run("ctx done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		nc := &normalizationConn{Conn: &readerConn{r: bytes.NewReader([]byte(testRequest))}, buffers: p, ctx: ctx}
+		_, err := nc.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestListenerMalformedRequestsReleaseBuffers(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	wl, _ := WrapListenerWithOpts(l, WrapListenerOpts{MaxBuffers: 2})
+	defer wl.Close()
+
+	// More malformed first requests than there are buffers. An empty Host makes
+	// algeneva.NormalizeRequest panic.
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost:\r\n\r\n"))
+		require.NoError(t, err)
+		c.Read(make([]byte, 1))
+		c.Close()
+	}
+
+	go func() {
+		if sc, err := wl.Accept(); err == nil {
+			go sc.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialContext(ctx, "tcp", l.Addr().String(), DialerOpts{})
+	require.NoError(t, err, "buffers should be available after malformed requests")
+	c.Close()
+}
+
+func BenchmarkNormalizationConn(b *testing.B) {
+	pools := map[string]func() bufferPool{
+		"per-conn": func() bufferPool { return nil },
+		"pooled":   func() bufferPool { return newSyncBufferPool() },
+		"fixed":    func() bufferPool { return newFixedBufferPool(1, normalizationBufferSize) },
+	}
+	for name, newPool := range pools {
+		b.Run(name, func(b *testing.B) {
+			pool := newPool()
+			req := []byte(testRequest)
+			out := make([]byte, 1024)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(req)))
+			for i := 0; i < b.N; i++ {
+				nc := &normalizationConn{Conn: &readerConn{r: bytes.NewReader(req)}, buffers: pool}
+				for {
+					if _, err := nc.Read(out); err != nil {
+						break
+					}
+				}
+				nc.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package genevahttp
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/getlantern/algeneva"
+)
+
+// strategyBundleVersion is the current version of the serialized strategy bundle format.
+const strategyBundleVersion = 1
+
+var (
+	// ErrUnsupportedBundleVersion is returned when a strategy bundle was serialized with a version
+	// of the format that is not supported.
+	ErrUnsupportedBundleVersion = errors.New("unsupported strategy bundle version")
+	// ErrInvalidBundleSignature is returned when a strategy bundle is missing a signature or the
+	// signature does not match its contents.
+	ErrInvalidBundleSignature = errors.New("invalid strategy bundle signature")
+)
+
+// strategyBundle is the serialized form of a set of geneva strategies keyed by region.
+type strategyBundle struct {
+	// Version is the version of the bundle format.
+	Version int `json:"version"`
+	// Strategies is a map of geneva strategies keyed by region, in the same format as
+	// algeneva.Strategies.
+	Strategies map[string][]string `json:"strategies"`
+	// Signature is an ed25519 signature of the bundle with Signature unset. It is empty if the
+	// bundle is not signed.
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// signedBytes returns the bytes of b that are covered by the signature.
+func (b strategyBundle) signedBytes() ([]byte, error) {
+	b.Signature = nil
+	return json.Marshal(b)
+}
+
+// MarshalStrategies serializes strategies into an unsigned, versioned bundle that can be loaded
+// with UnmarshalStrategies. Each strategy must compile with algeneva.NewHTTPStrategy.
+func MarshalStrategies(strategies map[string][]string) ([]byte, error) {
+	return marshalStrategies(strategies, nil)
+}
+
+// MarshalSignedStrategies serializes strategies into a versioned bundle signed with key. The
+// bundle can be loaded with UnmarshalSignedStrategies using the corresponding public key.
+func MarshalSignedStrategies(strategies map[string][]string, key ed25519.PrivateKey) ([]byte, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid ed25519 private key size: %d", len(key))
+	}
+
+	return marshalStrategies(strategies, key)
+}
+
+func marshalStrategies(strategies map[string][]string, key ed25519.PrivateKey) ([]byte, error) {
+	if err := validateStrategies(strategies); err != nil {
+		return nil, err
+	}
+
+	bundle := strategyBundle{Version: strategyBundleVersion, Strategies: strategies}
+	if key != nil {
+		msg, err := bundle.signedBytes()
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal strategy bundle: %w", err)
+		}
+
+		bundle.Signature = ed25519.Sign(key, msg)
+	}
+
+	return json.Marshal(bundle)
+}
+
+// UnmarshalStrategies loads a bundle created by MarshalStrategies or MarshalSignedStrategies and
+// returns the strategies it contains. UnmarshalStrategies does not verify the signature of signed
+// bundles; use UnmarshalSignedStrategies for that. An error is returned if the bundle is malformed,
+// was serialized with an unsupported version, or contains a strategy that doesn't compile.
+func UnmarshalStrategies(data []byte) (map[string][]string, error) {
+	bundle, err := unmarshalBundle(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return bundle.Strategies, nil
+}
+
+// UnmarshalSignedStrategies is like UnmarshalStrategies, but also requires the bundle to be signed
+// by the private key corresponding to key. ErrInvalidBundleSignature is returned if the bundle is
+// unsigned or has been tampered with.
+func UnmarshalSignedStrategies(data []byte, key ed25519.PublicKey) (map[string][]string, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key size: %d", len(key))
+	}
+
+	bundle, err := unmarshalBundle(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bundle.Signature) == 0 {
+		return nil, fmt.Errorf("%w: bundle is not signed", ErrInvalidBundleSignature)
+	}
+
+	msg, err := bundle.signedBytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal strategy bundle: %w", err)
+	}
+
+	if !ed25519.Verify(key, msg, bundle.Signature) {
+		return nil, ErrInvalidBundleSignature
+	}
+
+	return bundle.Strategies, nil
+}
+
+// unmarshalBundle parses data into a strategyBundle and validates its version and strategies.
+func unmarshalBundle(data []byte) (strategyBundle, error) {
+	var bundle strategyBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return bundle, fmt.Errorf("failed to unmarshal strategy bundle: %w", err)
+	}
+
+	if bundle.Version != strategyBundleVersion {
+		return bundle, fmt.Errorf("%w: %d", ErrUnsupportedBundleVersion, bundle.Version)
+	}
+
+	if err := validateStrategies(bundle.Strategies); err != nil {
+		return bundle, err
+	}
+
+	return bundle, nil
+}
+
+// validateStrategies returns an error if any of the strategies fail to compile.
+func validateStrategies(strategies map[string][]string) error {
+	for region, strats := range strategies {
+		for i, s := range strats {
+			if _, err := algeneva.NewHTTPStrategy(s); err != nil {
+				return fmt.Errorf("invalid strategy %s[%d]: %w", region, i, err)
+			}
+		}
+	}
+
+	return nil
+}
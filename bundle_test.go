@@ -0,0 +1,87 @@
+package genevahttp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/getlantern/algeneva"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalStrategies(t *testing.T) {
+	data, err := MarshalStrategies(algeneva.Strategies)
+	require.NoError(t, err)
+
+	got, err := UnmarshalStrategies(data)
+	require.NoError(t, err)
+	assert.Equal(t, algeneva.Strategies, got)
+
+	_, err = MarshalStrategies(map[string][]string{"China": {"not a strategy"}})
+	assert.Error(t, err)
+}
+
+func TestMarshalSignedStrategies(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	strategies := map[string][]string{"China": algeneva.Strategies["China"][:5]}
+	data, err := MarshalSignedStrategies(strategies, priv)
+	require.NoError(t, err)
+
+	got, err := UnmarshalSignedStrategies(data, pub)
+	require.NoError(t, err)
+	assert.Equal(t, strategies, got)
+
+	t.Run("tampered", func(t *testing.T) {
+		// Swap a region name for one of the same length so the bundle is still well-formed.
+		tampered := bytes.Replace(data, []byte("China"), []byte("Chine"), 1)
+		_, err := UnmarshalSignedStrategies(tampered, pub)
+		assert.ErrorIs(t, err, ErrInvalidBundleSignature)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		unsigned, err := MarshalStrategies(strategies)
+		require.NoError(t, err)
+
+		_, err = UnmarshalSignedStrategies(unsigned, pub)
+		assert.ErrorIs(t, err, ErrInvalidBundleSignature)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		otherPub, _, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+
+		_, err = UnmarshalSignedStrategies(data, otherPub)
+		assert.ErrorIs(t, err, ErrInvalidBundleSignature)
+	})
+}
+
+func TestUnmarshalStrategiesCorrupted(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr error
+	}{
+		{name: "malformed", data: `{"version":1,"strategies":`},
+		{
+			name:    "unsupported version",
+			data:    `{"version":99,"strategies":{}}`,
+			wantErr: ErrUnsupportedBundleVersion,
+		}, {
+			name:    "invalid strategy",
+			data:    `{"version":1,"strategies":{"China":["[HTTP:method:*]-insert{"]}}`,
+			wantErr: algeneva.ErrInvalidRule,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := UnmarshalStrategies([]byte(tt.data))
+			require.Error(t, err)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
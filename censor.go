@@ -0,0 +1,140 @@
+package genevahttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrCensorReset is the error wrapped by the *net.OpError a MockCensor's connection returns when it
+// resets the connection.
+var ErrCensorReset = errors.New("connection reset by censor")
+
+// CensorBehavior describes how a MockCensor interferes with the connections it dials.
+type CensorBehavior struct {
+	// InjectRST causes the first write to fail with a connection reset.
+	InjectRST bool
+	// BlockPage, if not empty, is returned to the client instead of the server's response. Any data
+	// written by the client is discarded.
+	BlockPage []byte
+	// DropAfter, if greater than zero, is the number of bytes the client can write before the
+	// remaining writes are silently dropped.
+	DropAfter int
+	// Delay is added before the connection is established.
+	Delay time.Duration
+	// LearnedPrefix, if not empty, causes the first write to fail with a connection reset if it
+	// starts with LearnedPrefix, as if the censor had learned the strategy that produced it.
+	LearnedPrefix []byte
+}
+
+// Presets for common censor behaviors.
+var (
+	CensorRST       = CensorBehavior{InjectRST: true}
+	CensorBlockPage = CensorBehavior{
+		BlockPage: []byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 7\r\nConnection: close\r\n\r\nblocked"),
+	}
+	CensorDropAfter = CensorBehavior{DropAfter: 16}
+	CensorDelay     = CensorBehavior{Delay: 200 * time.Millisecond}
+)
+
+// MockCensor is a Dialer that reproduces censorship behaviors on the connections it dials, so
+// strategies and fallbacks can be tested without a real censor. Set it as DialerOpts.Dialer.
+type MockCensor struct {
+	// Behavior is how the censor interferes with each connection.
+	Behavior CensorBehavior
+	// Dialer dials the underlying connections. If nil, a net.Dialer is used.
+	Dialer Dialer
+	// clock is used to wait out Behavior.Delay. If nil, the real clock is used.
+	clock clock
+}
+
+// Dial implements Dialer.
+func (d *MockCensor) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements Dialer.
+func (d *MockCensor) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.Behavior.Delay > 0 {
+		clk := d.clock
+		if clk == nil {
+			clk = realClock{}
+		}
+
+		t := clk.NewTimer(d.Behavior.Delay)
+		select {
+		case <-t.C():
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+
+	var dialer Dialer = &net.Dialer{}
+	if d.Dialer != nil {
+		dialer = d.Dialer
+	}
+	c, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &censoredConn{Conn: c, behavior: d.Behavior}
+	if len(d.Behavior.BlockPage) > 0 {
+		cc.blockPage = bytes.NewReader(d.Behavior.BlockPage)
+	}
+
+	return cc, nil
+}
+
+// censoredConn is a net.Conn that interferes with the wrapped connection according to behavior.
+type censoredConn struct {
+	net.Conn
+	behavior CensorBehavior
+	// written is the number of bytes the client has written.
+	written int
+	// blockPage is read by the client instead of the server's response.
+	blockPage *bytes.Reader
+}
+
+func (c *censoredConn) Write(b []byte) (int, error) {
+	switch {
+	case c.behavior.InjectRST,
+		c.written == 0 && len(c.behavior.LearnedPrefix) > 0 && bytes.HasPrefix(b, c.behavior.LearnedPrefix):
+		err := &net.OpError{
+			Op:     "write",
+			Net:    c.LocalAddr().Network(),
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    ErrCensorReset,
+		}
+		c.Conn.Close()
+		return 0, err
+	case c.blockPage != nil:
+		return len(b), nil
+	case c.behavior.DropAfter > 0 && c.written+len(b) > c.behavior.DropAfter:
+		// Forward what's left of the allowance and drop the rest.
+		allowed := max(c.behavior.DropAfter-c.written, 0)
+		c.written += len(b)
+		if allowed > 0 {
+			if _, err := c.Conn.Write(b[:allowed]); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+
+	n, err := c.Conn.Write(b)
+	c.written += n
+	return n, err
+}
+
+func (c *censoredConn) Read(b []byte) (int, error) {
+	if c.blockPage != nil {
+		return c.blockPage.Read(b)
+	}
+
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,181 @@
+package genevahttp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ Dialer = (*MockCensor)(nil)
+
+func TestDialCensored(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	go acceptAndClose(ll)
+
+	tests := []struct {
+		name     string
+		behavior CensorBehavior
+		wantErr  bool
+	}{
+		{name: "RST injection", behavior: CensorRST, wantErr: true},
+		{name: "block page", behavior: CensorBlockPage, wantErr: true},
+		{name: "drop after N bytes", behavior: CensorDropAfter, wantErr: true},
+		{name: "delay", behavior: CensorDelay, wantErr: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			opts := DialerOpts{
+				AlgenevaStrategy: testStrategy(t, "China", 17),
+				Dialer:           &MockCensor{Behavior: tt.behavior},
+			}
+			c, err := DialContext(ctx, "tcp", l.Addr().String(), opts)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			c.Close()
+		})
+	}
+}
+
+func TestDialContextFallbackStrategies(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	go acceptAndClose(ll)
+
+	// The censor has learned strategy 17, which replaces the method with "HTTP/1.1".
+	learned := testStrategy(t, "China", 17)
+	fallback := testStrategy(t, "China", 9)
+	dialer := &MockCensor{Behavior: CensorBehavior{LearnedPrefix: []byte("HTTP/1.1 ")}}
+
+	t.Run("fallback succeeds", func(t *testing.T) {
+		type outcome struct {
+			strategy string
+			err      error
+		}
+		var outcomes []outcome
+		opts := DialerOpts{
+			AlgenevaStrategy:   learned,
+			FallbackStrategies: []string{fallback},
+			Dialer:             dialer,
+			OnOutcome: func(_ context.Context, strategy string, err error) {
+				outcomes = append(outcomes, outcome{strategy, err})
+			},
+			OutcomeOnHandshake: true,
+		}
+		c, err := DialContext(context.Background(), "tcp", l.Addr().String(), opts)
+		require.NoError(t, err)
+		c.Close()
+
+		require.Len(t, outcomes, 2)
+		assert.Equal(t, learned, outcomes[0].strategy)
+		assert.Error(t, outcomes[0].err, "learned strategy should be rejected")
+		assert.Equal(t, fallback, outcomes[1].strategy)
+		assert.NoError(t, outcomes[1].err, "fallback strategy should succeed")
+	})
+	t.Run("all fail", func(t *testing.T) {
+		opts := DialerOpts{
+			AlgenevaStrategy:   learned,
+			FallbackStrategies: []string{learned},
+			Dialer:             dialer,
+		}
+		_, err := DialContext(context.Background(), "tcp", l.Addr().String(), opts)
+		assert.ErrorIs(t, err, ErrNoWorkingStrategy)
+		require.Error(t, err)
+		assert.Equal(t, 2, strings.Count(err.Error(), learned), "error should include each attempt")
+	})
+	t.Run("context done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		var tried int
+		opts := DialerOpts{
+			AlgenevaStrategy:   fallback,
+			FallbackStrategies: []string{fallback, fallback},
+			Dialer:             dialer,
+			OnOutcome:          func(context.Context, string, error) { tried++ },
+		}
+		_, err := DialContext(ctx, "tcp", l.Addr().String(), opts)
+		assert.ErrorIs(t, err, ErrNoWorkingStrategy)
+		assert.Equal(t, 1, tried, "no more strategies should be tried once the context is done")
+	})
+}
+
+func TestMockCensorRST(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	d := &MockCensor{Behavior: CensorRST}
+	c, err := d.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Write([]byte("GET / HTTP/1.1\r\n"))
+	assert.ErrorIs(t, err, ErrCensorReset)
+
+	var opErr *net.OpError
+	require.ErrorAs(t, err, &opErr)
+	assert.Equal(t, "write", opErr.Op)
+}
+
+func TestMockCensorDelay(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	clk := newFakeClock()
+	d := &MockCensor{Behavior: CensorDelay, clock: clk}
+
+	t.Run("elapsed", func(t *testing.T) {
+		dialed := make(chan error, 1)
+		go func() {
+			c, err := d.Dial("tcp", l.Addr().String())
+			if err == nil {
+				c.Close()
+			}
+			dialed <- err
+		}()
+
+		clk.waitForTimers(1)
+		select {
+		case <-dialed:
+			t.Fatal("dial returned before the delay elapsed")
+		default:
+		}
+
+		clk.Advance(CensorDelay.Delay)
+		assert.NoError(t, <-dialed)
+	})
+	t.Run("context done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		dialed := make(chan error, 1)
+		go func() {
+			_, err := d.DialContext(ctx, "tcp", l.Addr().String())
+			dialed <- err
+		}()
+
+		clk.waitForTimers(1)
+		cancel()
+		assert.ErrorIs(t, <-dialed, context.Canceled)
+	})
+}
@@ -0,0 +1,50 @@
+package genevahttp
+
+import "time"
+
+// clock provides the current time and timers. It allows time-based code paths to be driven by a
+// fake clock in tests.
+type clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Since returns the time elapsed since t.
+	Since(t time.Time) time.Duration
+	// After waits for d to elapse and then sends the current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+	// NewTimer creates a timer that sends the current time on its channel after d.
+	NewTimer(d time.Duration) timer
+	// AfterFunc waits for d to elapse and then calls f in its own goroutine. Unlike NewTimer, no
+	// goroutine is needed to wait on the timer, so it's preferred for per-connection timers. The
+	// returned timer's C returns nil.
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer is a clock's equivalent of time.Timer.
+type timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. It returns false if the timer already fired or was
+	// stopped.
+	Stop() bool
+	// Reset changes the timer to expire after d. It returns true if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// realClock is a clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) timer         { return realTimer{time.NewTimer(d)} }
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+// realTimer is a timer backed by a time.Timer.
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
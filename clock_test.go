@@ -0,0 +1,115 @@
+package genevahttp
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves forward when Advance is called.
+type fakeClock struct {
+	mx     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	// timerAdded receives a value each time a timer is created or reset.
+	timerAdded chan struct{}
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:        time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		timerAdded: make(chan struct{}, 100),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	t := &fakeTimer{clock: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing any timers that expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.now = c.now.Add(d)
+	active := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			active = append(active, t)
+			continue
+		}
+
+		if t.f != nil {
+			go t.f()
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = active
+}
+
+// waitForTimers blocks until n timers have been created or reset.
+func (c *fakeClock) waitForTimers(n int) {
+	for i := 0; i < n; i++ {
+		<-c.timerAdded
+	}
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	c        chan time.Time
+	deadline time.Time
+	// f, if not nil, is called instead of sending on c.
+	f func()
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mx.Lock()
+	defer t.clock.mx.Unlock()
+
+	for i, tt := range t.clock.timers {
+		if tt == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	active := t.Stop()
+
+	t.clock.mx.Lock()
+	t.deadline = t.clock.now.Add(d)
+	t.clock.timers = append(t.clock.timers, t)
+	t.clock.mx.Unlock()
+
+	t.clock.timerAdded <- struct{}{}
+	return active
+}
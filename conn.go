@@ -2,13 +2,83 @@ package genevahttp
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/getlantern/algeneva"
 )
 
+var (
+	// ErrTransformNoOp is returned when a transform is required but the geneva strategy did not
+	// modify the request.
+	ErrTransformNoOp = errors.New("geneva strategy did not modify the request")
+	// ErrEmptyNormalization is returned when normalizing the first request produced no data.
+	ErrEmptyNormalization = errors.New("normalized request is empty")
+	// ErrInvalidTransform is returned when a transformed request is verified and can't be
+	// normalized, meaning the server would not be able to recover it.
+	ErrInvalidTransform = errors.New("transformed request cannot be normalized")
+	// ErrNormalization is wrapped by errors returned by normalizationConn while reading and
+	// normalizing the first request.
+	ErrNormalization = errors.New("normalization failed")
+	// ErrConnIO is wrapped by errors returned by normalizationConn after the first request has been
+	// normalized. io.EOF is returned as is.
+	ErrConnIO = errors.New("connection I/O failed")
+	// ErrFirstRequestNotWritten is wrapped by errors returned by httpTransformConn.Write if the
+	// buffered first request couldn't be transformed or written to the wire.
+	ErrFirstRequestNotWritten = errors.New("first request not written")
+	// ErrFirstRequestTimeout is returned by normalizationConn.Read if the first request's headers
+	// aren't read within the first request timeout.
+	ErrFirstRequestTimeout = errors.New("timed out reading first request")
+	// ErrHeaderTooLarge is returned by httpTransformConn.Write and normalizationConn.Read if the end
+	// of the first request's headers isn't found within the maximum header size.
+	ErrHeaderTooLarge = errors.New("request header too large")
+	// ErrRequestTooLarge is returned by httpTransformConn.Write if the transformed request is larger
+	// than the configured limit.
+	ErrRequestTooLarge = errors.New("transformed request too large")
+	// ErrNoData is reported to DialerOpts.OnOutcome if a connection is closed before any data was
+	// read from it.
+	ErrNoData = errors.New("connection closed before any data was read")
+)
+
+// DefaultMaxHeaderBytes is the default maximum size of the first request's headers.
+const DefaultMaxHeaderBytes = 64 << 10
+
+// phaseError is an error tagged with the phase of the connection it occurred in. It implements
+// net.Error so callers that check for timeouts still see them.
+type phaseError struct {
+	// phase is the sentinel error identifying the phase, e.g. ErrNormalization.
+	phase error
+	// err is the underlying error.
+	err error
+}
+
+func (e *phaseError) Error() string { return e.phase.Error() + ": " + e.err.Error() }
+
+func (e *phaseError) Unwrap() []error { return []error{e.phase, e.err} }
+
+// Timeout reports whether the underlying error is a timeout.
+func (e *phaseError) Timeout() bool {
+	var ne net.Error
+	return errors.As(e.err, &ne) && ne.Timeout()
+}
+
+// Temporary reports whether the underlying error is temporary.
+func (e *phaseError) Temporary() bool {
+	var ne net.Error
+	return errors.As(e.err, &ne) && ne.Temporary()
+}
+
 // httpTransformConn is a wrapper around a net.conn. httpTransformConn will apply the geneva
 // strategy, httpTransform, to the first request before writing it to the wrapped net.Conn.
 // Subsequent requests are written directly to the wrapped net.Conn.
@@ -17,6 +87,8 @@ type httpTransformConn struct {
 	net.Conn
 	// httpTransformConn is the geneva strategy to apply to the first request.
 	httpTransform *algeneva.HTTPStrategy
+	// strategy is the strategy string httpTransform was compiled from, reported by ConnStrategy.
+	strategy string
 	// buf is a buffer to write the first request into until we can apply the geneva strategy. Once
 	// all of the request header is writen to buf, we'll apply the geneva strategy and write the
 	// transformed request to net.Conn.
@@ -26,6 +98,57 @@ type httpTransformConn struct {
 	eohCheckPtr int
 	// transformedFirst is a flag to indicate if the first request has been transformed.
 	transformedFirst bool
+	// ctx is the context the connection was dialed with. It is passed to onTransform.
+	ctx context.Context
+	// onTransform, if not nil, is called with the original and transformed request after the geneva
+	// strategy is applied.
+	onTransform func(ctx context.Context, req, transformed []byte)
+	// requireTransform causes Write to return ErrTransformNoOp instead of writing the request if the
+	// geneva strategy did not modify it.
+	requireTransform bool
+	// verifyTransform causes Write to return ErrInvalidTransform instead of writing the request if
+	// the transformed request can't be normalized.
+	verifyTransform bool
+	// streamHeaders causes Write to transform and send the request-line as soon as it's complete,
+	// instead of buffering all of the headers. It must only be set if httpTransform only modifies
+	// the request-line. Note that the transformed request-line may then be sent in its own write.
+	streamHeaders bool
+	// maxHeaderBytes is the maximum number of bytes buffered while waiting for the end of the
+	// headers before Write returns ErrHeaderTooLarge. If zero, DefaultMaxHeaderBytes is used.
+	maxHeaderBytes int
+	// maxRequestBytes, if greater than zero, causes Write to return ErrRequestTooLarge instead of
+	// writing the transformed request if it's larger than maxRequestBytes.
+	maxRequestBytes int
+	// headerTimeout, if greater than zero, is how long the first request may be buffered before it's
+	// written to the wrapped net.Conn as is, in case the headers never complete. If
+	// requireTransform is set, the connection is closed instead.
+	headerTimeout time.Duration
+	// sentRaw is set if the first request was written without applying the strategy, either because
+	// it didn't start with one of methods or because the header timeout elapsed.
+	sentRaw bool
+	// logger, if not nil, is warned when the first request is written without applying the
+	// strategy.
+	logger *slog.Logger
+	// headerErr is set if the header timeout elapsed and the buffered request was dropped rather
+	// than written untransformed. Write returns it from then on.
+	headerErr error
+	// methods lists the HTTP methods that mark the first write as a request to transform. If empty,
+	// defaultTransformMethods is used.
+	methods []string
+	// methodMatched is set once the first write is known to start with one of methods.
+	methodMatched bool
+	// metrics, if not nil, is told when the first request has been transformed.
+	metrics Metrics
+	// bufStart is when the first data was buffered.
+	bufStart time.Time
+	// clock is used for headerTimeout.
+	clock clock
+	// headerTimer flushes the first request when headerTimeout elapses. It's stopped once the first
+	// request has been written.
+	headerTimer timer
+	// mx guards the state of the first request, since net.Conn allows concurrent writes, e.g. a
+	// websocket close frame written while the transformed request is still being written.
+	mx sync.Mutex
 }
 
 // Write writes data to the connection. If the first request has not been transformed and
@@ -33,47 +156,323 @@ type httpTransformConn struct {
 // written. Once all the headers have been written, Write will apply the geneva strategy and write
 // the transformed request to the wrapped connection. Otherwise, Write will write the data directly
 // to the wrapped net.Conn as is.
+//
+// While the first request is buffered, Write reports b as written even though it hasn't reached
+// the wire yet. If the buffered request can't be transformed or written, Write returns 0 and an
+// error wrapping ErrFirstRequestNotWritten. b is then dropped from the buffer, while the bytes from
+// earlier writes remain buffered.
 func (c *httpTransformConn) Write(b []byte) (n int, err error) {
-	if c.transformedFirst || c.httpTransform == nil || len(b) == 0 {
-		// The first request has been transformed, or the caller didn't pass any data to write, so we
-		// just forward b to Conn.
+	if c.httpTransform == nil || len(b) == 0 {
+		// There's nothing to transform, or the caller didn't pass any data to write, so we just
+		// forward b to Conn.
+		return c.Conn.Write(b)
+	}
+
+	c.mx.Lock()
+	if c.transformedFirst {
+		// The first request has been transformed, so we just forward b to Conn.
+		c.mx.Unlock()
 		return c.Conn.Write(b)
 	}
+	defer c.mx.Unlock()
+
+	if c.headerErr != nil {
+		return 0, fmt.Errorf("%w: %w", ErrFirstRequestNotWritten, c.headerErr)
+	}
 
 	// The first request has not been transformed, so we write to buf and check if we recieved all
 	// of the request headers.
 	if c.buf == nil {
 		c.buf = &bytes.Buffer{}
+		c.bufStart = c.getClock().Now()
+		c.startHeaderTimer()
 	}
 
 	nw, _ := c.buf.Write(b)
+	if err := c.writeFirst(); err != nil {
+		// b didn't make it to the wire, so we drop it from buf and report it as not written so the
+		// caller's count is accurate.
+		c.buf.Truncate(c.buf.Len() - nw)
+		c.eohCheckPtr = min(c.eohCheckPtr, c.buf.Len())
+		return 0, fmt.Errorf("%w: %w", ErrFirstRequestNotWritten, err)
+	}
+
+	return nw, nil
+}
+
+// writeFirst transforms and writes the first request in c.buf if enough of it has been buffered.
+// Otherwise, it leaves c.buf as is.
+func (c *httpTransformConn) writeFirst() error {
+	if !c.methodMatched {
+		methods := c.methods
+		if len(methods) == 0 {
+			methods = defaultTransformMethods
+		}
+
+		switch matchMethod(c.buf.Bytes(), methods) {
+		case methodUnknown:
+			// The method may still be incomplete, so we keep buffering.
+			return nil
+		case methodNotFound:
+			return c.writeUntransformed()
+		}
+		c.methodMatched = true
+	}
+
+	if c.streamHeaders {
+		// The strategy only modifies the request-line, so we can transform and send it as soon as
+		// it's complete rather than waiting for the rest of the headers.
+		if i := bytes.Index(c.buf.Bytes(), []byte("\r\n")); i != -1 {
+			return c.transformRequestLine(i)
+		}
+
+		return c.checkHeaderSize()
+	}
+
 	// We need to check if we've recieved all of the headers before we can apply the geneva
 	// strategy. Since the headers are terminated by a string and not just one byte, we need to
 	// check c.buf, as '\r\n\r\n' may be split between two writes.
-	if !bytes.Contains(c.buf.Bytes()[c.eohCheckPtr:], []byte("\r\n\r\n")) {
-		// We haven't recieved all of the headers yet, so update eohCheckPtr to the end of the buffer
-		// but back up 3 bytes in case some of the token was written already.
-		shift := c.buf.Len() - 3
-		c.eohCheckPtr += max(shift, 0)
-		return nw, nil
+	eoh := []byte("\r\n\r\n")
+	if !bytes.Contains(c.buf.Bytes()[c.eohCheckPtr:], eoh) {
+		// We haven't recieved all of the headers yet, so move eohCheckPtr to the end of the buffer
+		// but back up len(eoh)-1 bytes in case all but the last byte of the token was written
+		// already. eohCheckPtr is an absolute index into buf, so it's set rather than advanced, and
+		// it's clamped at 0 for writes smaller than the token.
+		c.eohCheckPtr = max(c.buf.Len()-(len(eoh)-1), 0)
+		return c.checkHeaderSize()
 	}
 
 	req, err := c.httpTransform.Apply(c.buf.Bytes())
 	if err != nil {
-		return nw, fmt.Errorf("error applying geneva strategy: %w", err)
+		return fmt.Errorf("error applying geneva strategy: %w", err)
+	}
+
+	if c.verifyTransform {
+		if _, err := normalizeRequest(req); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidTransform, err)
+		}
+	}
+
+	return c.writeTransformed(req)
+}
+
+// writeUntransformed writes c.buf to the wrapped net.Conn as is, since it isn't a request the
+// strategy should be applied to, and marks the first request as written. If c.requireTransform is
+// set, ErrTransformNoOp is returned instead.
+func (c *httpTransformConn) writeUntransformed() error {
+	if c.requireTransform {
+		return fmt.Errorf("%w: first write doesn't start with a transform method", ErrTransformNoOp)
+	}
+
+	if _, err := c.Conn.Write(c.buf.Bytes()); err != nil {
+		return fmt.Errorf("error writing untransformed request: %w", err)
+	}
+
+	c.markSentRaw("first write doesn't start with a transform method")
+	c.finishFirst()
+	return nil
+}
+
+// markSentRaw records that the first request was written as is, warning c.logger, if set, with
+// the reason. It must be called with c.mx held.
+func (c *httpTransformConn) markSentRaw(reason string) {
+	c.sentRaw = true
+	if c.logger != nil {
+		ctx := c.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		c.logger.LogAttrs(ctx, slog.LevelWarn, "genevahttp: first request sent untransformed",
+			slog.String("strategy", c.strategy),
+			slog.String("reason", reason),
+			slog.Int("bytes", c.buf.Len()),
+		)
+	}
+}
+
+// checkHeaderSize returns ErrHeaderTooLarge if c.buf holds more than the maximum header size. It
+// must only be called if the end of the headers hasn't been found.
+func (c *httpTransformConn) checkHeaderSize() error {
+	limit := c.maxHeaderBytes
+	if limit <= 0 {
+		limit = DefaultMaxHeaderBytes
+	}
+
+	if c.buf.Len() > limit {
+		return fmt.Errorf("%w: no end of headers in %d bytes", ErrHeaderTooLarge, c.buf.Len())
 	}
 
-	_, err = c.Conn.Write(req)
+	return nil
+}
+
+// transformRequestLine applies the geneva strategy to the request-line, which ends at index eol of
+// c.buf, and writes the transformed request-line along with the rest of c.buf to the wrapped
+// net.Conn. It must only be used with strategies that only modify the request-line.
+func (c *httpTransformConn) transformRequestLine(eol int) error {
+	// HTTPStrategy.Apply requires a complete request, so we apply it to the request-line with an
+	// empty header block. Apply returns the request-line followed by "\r\n" and an empty header
+	// block, "\r\n\r\n", which we trim off.
+	line := c.buf.Bytes()[:eol]
+	req := append(append([]byte{}, line...), "\r\n\r\n"...)
+	transformed, err := c.httpTransform.Apply(req)
 	if err != nil {
-		return nw, fmt.Errorf("error writing transformed request: %w", err)
+		return fmt.Errorf("error applying geneva strategy: %w", err)
+	}
+
+	if c.verifyTransform {
+		if _, err := normalizeRequest(transformed); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidTransform, err)
+		}
+	}
+
+	transformed = transformed[:len(transformed)-len("\r\n\r\n\r\n")]
+	return c.writeTransformed(append(transformed, c.buf.Bytes()[eol:]...))
+}
+
+// writeTransformed writes the transformed first request, req, to the wrapped net.Conn in place of
+// the contents of c.buf and marks the first request as transformed.
+func (c *httpTransformConn) writeTransformed(req []byte) error {
+	if c.requireTransform && bytes.Equal(req, c.buf.Bytes()) {
+		return ErrTransformNoOp
+	}
+
+	if c.maxRequestBytes > 0 && len(req) > c.maxRequestBytes {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrRequestTooLarge, len(req), c.maxRequestBytes)
+	}
+
+	if c.onTransform != nil {
+		c.onTransform(c.ctx, c.buf.Bytes(), req)
+	}
+
+	// The transformed request is always written in a single call so the mangled request-line isn't
+	// isolated in its own write. Note that this doesn't guarantee a single TCP segment; requests
+	// larger than the path MTU will still be split by the network stack.
+	if _, err := c.Conn.Write(req); err != nil {
+		return fmt.Errorf("error writing transformed request: %w", err)
+	}
+
+	if c.metrics != nil {
+		c.metrics.FirstRequestTransformed(c.buf.Len(), c.getClock().Since(c.bufStart))
 	}
 
 	// The first request has been transformed, so we set transformedFirst to true and clear the
 	// buffer.
+	c.finishFirst()
+	return nil
+}
+
+// finishFirst marks the first request as written, clears c.buf, and stops the header timer. It
+// must be called with c.mx held.
+func (c *httpTransformConn) finishFirst() {
 	c.transformedFirst = true
 	c.buf.Reset()
 	c.buf = nil
-	return nw, nil
+	if c.headerTimer != nil {
+		c.headerTimer.Stop()
+		c.headerTimer = nil
+	}
+}
+
+// startHeaderTimer starts a timer that flushes c.buf untransformed if the headers don't complete
+// within c.headerTimeout. It does nothing if c.headerTimeout is not set. It must be called with
+// c.mx held.
+func (c *httpTransformConn) startHeaderTimer() {
+	if c.headerTimeout <= 0 {
+		return
+	}
+
+	c.headerTimer = c.getClock().AfterFunc(c.headerTimeout, c.flushUntransformed)
+}
+
+// getClock returns c.clock, or the real clock if it is nil.
+func (c *httpTransformConn) getClock() clock {
+	if c.clock == nil {
+		return realClock{}
+	}
+
+	return c.clock
+}
+
+// flushUntransformed writes c.buf to the wrapped net.Conn as is, without applying the strategy, so
+// data from a caller that never completes the headers isn't held forever. If the write fails, the
+// connection is closed since the buffered data is lost. If c.requireTransform is set, the buffered
+// data is dropped and the connection is closed instead, and later writes fail.
+func (c *httpTransformConn) flushUntransformed() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.transformedFirst || c.buf == nil {
+		return
+	}
+
+	if c.requireTransform {
+		// Sending the request untransformed would break the promise to fail closed.
+		c.headerErr = fmt.Errorf("%w: headers not complete within %v", ErrTransformNoOp, c.headerTimeout)
+		c.buf = nil
+		c.headerTimer = nil
+		c.Conn.Close()
+		return
+	}
+
+	if _, err := c.Conn.Write(c.buf.Bytes()); err != nil {
+		c.Conn.Close()
+	}
+	c.markSentRaw("headers not complete within " + c.headerTimeout.String())
+	c.finishFirst()
+}
+
+// TransformedFirstRequest reports whether the strategy was applied to the first request. It's false
+// until the first request has been written, and stays false if the first request was written as
+// is.
+func (c *httpTransformConn) TransformedFirstRequest() bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.httpTransform != nil && c.transformedFirst && !c.sentRaw
+}
+
+// TransformedFirstRequest reports whether the geneva strategy was applied to the connect request of
+// c, a connection returned by DialContext, through any of the wrapping added by DialerOpts. It's
+// false if the request was sent un-obfuscated, e.g. because it didn't start with one of
+// DialerOpts.TransformMethods. ok is false if c wasn't dialed with a strategy.
+func TransformedFirstRequest(c net.Conn) (transformed, ok bool) {
+	for ; c != nil; c = unwrapConn(c) {
+		if htc, isHTC := c.(*httpTransformConn); isHTC && htc.httpTransform != nil {
+			return htc.TransformedFirstRequest(), true
+		}
+	}
+
+	return false, false
+}
+
+// chunkedConn is a wrapper around a net.Conn that splits writes larger than chunkSize into
+// multiple writes of at most chunkSize bytes. When wrapping a websocket.NetConn, each write is sent
+// as a separate websocket message, so chunkedConn can be used to cap the size of the messages. The
+// read side doesn't need to do anything special since websocket.NetConn is a byte stream.
+type chunkedConn struct {
+	// Wrapped connection
+	net.Conn
+	// chunkSize is the maximum number of bytes written to the wrapped net.Conn in a single write.
+	chunkSize int
+}
+
+// Write writes b to the wrapped net.Conn in chunks of at most c.chunkSize bytes. Write returns the
+// total number of bytes written and the first error encountered, if any.
+func (c *chunkedConn) Write(b []byte) (n int, err error) {
+	if c.chunkSize <= 0 || len(b) <= c.chunkSize {
+		return c.Conn.Write(b)
+	}
+
+	for len(b) > 0 {
+		chunk := b[:min(c.chunkSize, len(b))]
+		nw, err := c.Conn.Write(chunk)
+		n += nw
+		if err != nil {
+			return n, err
+		}
+
+		b = b[nw:]
+	}
+
+	return n, nil
 }
 
 // normalizationConn is a wrapper around a net.conn. normalizationConn will attempt to normalize
@@ -90,54 +489,441 @@ type normalizationConn struct {
 	buf *bytes.Buffer
 	// normalizedFirst is a flag to indicate if the first request has been normalized.
 	normalizedFirst bool
+	// normalize is used to normalize the first request. If nil, normalizeRequest is used.
+	normalize func(req []byte) ([]byte, error)
+	// onNormalize, if not nil, is called with copies of the first request as read and as
+	// normalized. normalized is nil if normalization failed.
+	onNormalize func(original, normalized []byte)
+	// maxHeaderBytes is the maximum number of bytes read while waiting for the end of the first
+	// request's headers before Read returns ErrHeaderTooLarge. If zero, DefaultMaxHeaderBytes is
+	// used.
+	maxHeaderBytes int
+	// firstRequestTimeout, if greater than zero, is how long Read waits for the first request's
+	// headers before returning ErrFirstRequestTimeout.
+	firstRequestTimeout time.Duration
+	// deadlineMx guards readDeadline.
+	deadlineMx sync.Mutex
+	// readDeadline is the read deadline set by the caller. It's restored once the first request has
+	// been read, since the first request timeout overrides it.
+	readDeadline time.Time
+	// buffers, if not nil, provides buf. buf is returned to it once the normalized request has been
+	// read or the connection is closed. If nil, buf is allocated for the connection.
+	buffers bufferPool
+	// bufMx guards buf and closed, since Close may be called concurrently with Read.
+	bufMx  sync.Mutex
+	closed bool
+	// metrics, if not nil, is told whether the first request was normalized.
+	metrics Metrics
+	// prebuffered holds the start of the first request if it was already read from the wrapped
+	// net.Conn, e.g. by a protocol demultiplexer sniffing the first bytes. It's read before the
+	// wrapped net.Conn.
+	prebuffered []byte
+	// ctx, if not nil, aborts reading the first request when it's done, e.g. when the listener is
+	// closed.
+	ctx context.Context
+	// clock is used to time the normalization of the first request. If nil, the real clock is used.
+	clock clock
+	// handshakes, if not nil, tracks the connection from the first byte of its first request until
+	// the request reaches the handler, the first request fails, or the connection is closed.
+	handshakes *handshakeTracker
+	// handshakeState is 0 until the connection is added to handshakes, 1 while it's tracked, and 2
+	// once it's done.
+	handshakeState atomic.Int32
+}
+
+// newNormalizationConn returns a normalizationConn that normalizes the first request read from c.
+// prebuffered, if not empty, is data that was already read from c, such as part of the first
+// request's headers; it's treated as if it were the start of c.
+func newNormalizationConn(c net.Conn, prebuffered []byte) *normalizationConn {
+	return &normalizationConn{Conn: c, prebuffered: bytes.Clone(prebuffered)}
 }
 
 // Read reads data from the connection. If the first request has not been normalized, Read will
 // attempt to normalize it. The first call to Read may take slightly longer than expected as it
 // must read at least the request-line and headers to normalize the request.
+//
+// The first call to Read returns as much of the normalized first request, including any data that
+// followed it in the same read from the wrapped net.Conn, as fits in b. If b is large enough, the
+// whole normalized request is returned by a single Read; otherwise, the rest is returned by
+// subsequent calls before any more data is read from the wrapped net.Conn.
+//
+// Errors encountered while reading and normalizing the first request wrap ErrNormalization. Errors
+// encountered afterwards, other than io.EOF, wrap ErrConnIO.
 func (nc *normalizationConn) Read(b []byte) (n int, err error) {
 	if nc.normalizedFirst {
 		// The first request has been normalized, so we read from buf if it's not empty.
-		if nc.buf.Len() > 0 {
-			return nc.buf.Read(b)
+		if n, ok := nc.readBuffered(b); ok {
+			return n, nil
 		}
 
-		return nc.Conn.Read(b)
+		n, err = nc.Conn.Read(b)
+		if err != nil && err != io.EOF {
+			err = &phaseError{phase: ErrConnIO, err: err}
+		}
+		return n, err
 	}
 
-	if nc.buf == nil {
-		nc.buf = &bytes.Buffer{}
+	clk := nc.clock
+	if clk == nil {
+		clk = realClock{}
+	}
+
+	start := clk.Now()
+	n, err = nc.readFirst(b)
+	if err != nil {
+		err = &phaseError{phase: ErrNormalization, err: err}
+	}
+
+	if nc.metrics != nil {
+		if err != nil {
+			nc.metrics.NormalizeFailed(err)
+		} else {
+			nc.metrics.FirstRequestNormalized(clk.Since(start))
+		}
+	}
+	return n, err
+}
+
+// readFirst reads and normalizes the first request, then reads from the normalized request into b.
+func (nc *normalizationConn) readFirst(b []byte) (n int, err error) {
+	limit := nc.maxHeaderBytes
+	if limit <= 0 {
+		limit = DefaultMaxHeaderBytes
+	}
+
+	ctx := nc.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// Waiting for a buffer counts against the first request timeout too, so a pool exhausted by
+	// stalled clients can't hold up the others forever.
+	bufCtx := ctx
+	if nc.firstRequestTimeout > 0 {
+		deadline, err := nc.setFirstRequestDeadline()
+		if err != nil {
+			return 0, err
+		}
+
+		var cancel context.CancelFunc
+		bufCtx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	buf, err := nc.getBuffer(bufCtx)
+	if err != nil {
+		if nc.firstRequestTimeout > 0 && errors.Is(err, context.DeadlineExceeded) {
+			return 0, fmt.Errorf("%w: waiting for a buffer: %w", ErrFirstRequestTimeout, err)
+		}
+		return 0, err
+	}
+
+	// buf is handed to nc once the request is normalized. On any other path, including a panic
+	// while normalizing, it's returned to the pool so it isn't leaked.
+	var handedOff bool
+	defer func() {
+		if !handedOff {
+			nc.putBuffer(buf)
+		}
+	}()
+
+	var src io.Reader = nc.Conn
+	if len(nc.prebuffered) > 0 {
+		// Keep the wrapped net.Conn's SetReadDeadline so the read can still be cancelled.
+		src = struct {
+			io.Reader
+			readDeadliner
+		}{io.MultiReader(bytes.NewReader(nc.prebuffered), nc.Conn), nc.Conn}
+		nc.prebuffered = nil
+	}
+	if nc.handshakes != nil {
+		src = struct {
+			io.Reader
+			readDeadliner
+		}{&firstByteReader{r: src, onFirstByte: nc.startHandshake}, src.(readDeadliner)}
 	}
 
 	// We don't need the whole request to normalize it, just the request-line and headers.
-	n, err = readAtLeastUntil(nc.Conn, nc.buf, []byte("\r\n\r\n"))
+	n, err = readAtLeastUntil(ctx, src, buf, []byte("\r\n\r\n"), limit)
 	if err != nil {
+		nc.endHandshake()
+		if errors.Is(err, errReadLimit) {
+			return 0, fmt.Errorf("%w: no end of headers in %d bytes", ErrHeaderTooLarge, limit)
+		}
+		if nc.firstRequestTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, fmt.Errorf("%w: %w", ErrFirstRequestTimeout, err)
+		}
 		return 0, err
 	}
 
-	norm, err := algeneva.NormalizeRequest(nc.buf.Bytes()[:n])
+	if nc.firstRequestTimeout > 0 {
+		// Restore the caller's deadline so the first request timeout doesn't affect later reads.
+		nc.deadlineMx.Lock()
+		err := nc.Conn.SetReadDeadline(nc.readDeadline)
+		nc.deadlineMx.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	normalize := nc.normalize
+	if normalize == nil {
+		normalize = normalizeRequest
+	}
+
+	norm, err := normalize(buf.Bytes()[:n])
+	if nc.onNormalize != nil {
+		// buf is reused for the normalized request, so the callback gets copies.
+		var normalized []byte
+		if err == nil {
+			normalized = bytes.Clone(norm)
+		}
+		nc.onNormalize(bytes.Clone(buf.Bytes()[:n]), normalized)
+	}
 	if err != nil {
+		nc.endHandshake()
 		return 0, err
 	}
 
+	// An empty result would leave nothing to read in place of the request, which would look like
+	// the client sent nothing at all, so we treat it as a failure and close the connection.
+	if len(norm) == 0 {
+		nc.Close()
+		return 0, ErrEmptyNormalization
+	}
+
 	nc.normalizedFirst = true
 
 	// Clear the buffer so we can reuse it for storing the normalized request.
-	nc.buf.Reset()
-	nc.buf.Write(norm)
-	// we can ignore the error here since bytes.Buffer.Read will only return an error if the buffer
-	//	is empty, which we just wrote to.
-	n, _ = nc.buf.Read(b)
+	buf.Reset()
+	buf.Write(norm)
+
+	nc.bufMx.Lock()
+	if nc.closed {
+		nc.bufMx.Unlock()
+		return 0, net.ErrClosed
+	}
+	nc.buf = buf
+	handedOff = true
+	nc.bufMx.Unlock()
+
+	// we can ignore the result here since buf will only be empty if the normalized request is
+	// empty, which we checked above.
+	n, _ = nc.readBuffered(b)
 	return n, nil
 }
 
+// setFirstRequestDeadline sets the wrapped net.Conn's read deadline to nc.firstRequestTimeout from
+// now, or the caller's deadline if it's earlier, and returns the deadline.
+func (nc *normalizationConn) setFirstRequestDeadline() (time.Time, error) {
+	nc.deadlineMx.Lock()
+	defer nc.deadlineMx.Unlock()
+
+	deadline := time.Now().Add(nc.firstRequestTimeout)
+	if !nc.readDeadline.IsZero() && nc.readDeadline.Before(deadline) {
+		deadline = nc.readDeadline
+	}
+
+	return deadline, nc.Conn.SetReadDeadline(deadline)
+}
+
+// SetReadDeadline implements net.Conn. The deadline is recorded so it can be restored after the
+// first request timeout.
+func (nc *normalizationConn) SetReadDeadline(t time.Time) error {
+	nc.deadlineMx.Lock()
+	defer nc.deadlineMx.Unlock()
+	nc.readDeadline = t
+	return nc.Conn.SetReadDeadline(t)
+}
+
+// SetDeadline implements net.Conn. See SetReadDeadline.
+func (nc *normalizationConn) SetDeadline(t time.Time) error {
+	nc.deadlineMx.Lock()
+	defer nc.deadlineMx.Unlock()
+	nc.readDeadline = t
+	return nc.Conn.SetDeadline(t)
+}
+
+// readBuffered reads from the normalized request in buf into b. ok is false if buf has already been
+// drained. buf is released once it is drained.
+func (nc *normalizationConn) readBuffered(b []byte) (n int, ok bool) {
+	nc.bufMx.Lock()
+	defer nc.bufMx.Unlock()
+	if nc.buf == nil {
+		return 0, false
+	}
+
+	n, _ = nc.buf.Read(b)
+	if nc.buf.Len() == 0 {
+		nc.putBuffer(nc.buf)
+		nc.buf = nil
+	}
+	return n, true
+}
+
+// Close closes the wrapped net.Conn and releases buf if the normalized request hasn't been drained.
+func (nc *normalizationConn) Close() error {
+	nc.bufMx.Lock()
+	nc.closed = true
+	if nc.buf != nil {
+		nc.putBuffer(nc.buf)
+		nc.buf = nil
+	}
+	nc.bufMx.Unlock()
+
+	nc.endHandshake()
+	return nc.Conn.Close()
+}
+
+// startHandshake adds nc to nc.handshakes unless it's already done.
+func (nc *normalizationConn) startHandshake() {
+	nc.handshakes.add()
+	if !nc.handshakeState.CompareAndSwap(0, 1) {
+		nc.handshakes.done()
+	}
+}
+
+// endHandshake removes nc from nc.handshakes if it was added. It's safe to call more than once and
+// concurrently with startHandshake.
+func (nc *normalizationConn) endHandshake() {
+	if nc.handshakeState.Swap(2) == 1 {
+		nc.handshakes.done()
+	}
+}
+
+// firstByteReader calls onFirstByte the first time a read from r returns data.
+type firstByteReader struct {
+	r           io.Reader
+	onFirstByte func()
+	called      bool
+}
+
+func (r *firstByteReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 && !r.called {
+		r.called = true
+		r.onFirstByte()
+	}
+	return n, err
+}
+
+// getBuffer returns a buffer from nc.buffers, or a new buffer if nc.buffers is nil.
+func (nc *normalizationConn) getBuffer(ctx context.Context) (*bytes.Buffer, error) {
+	if nc.buffers == nil {
+		return &bytes.Buffer{}, nil
+	}
+
+	return nc.buffers.get(ctx)
+}
+
+// putBuffer returns buf to nc.buffers, if set.
+func (nc *normalizationConn) putBuffer(buf *bytes.Buffer) {
+	if nc.buffers != nil {
+		nc.buffers.put(buf)
+	}
+}
+
+// defaultTransformMethods are the HTTP methods that mark the first write as a request to transform
+// if none are configured: the methods defined in RFC 9110, plus PATCH.
+var defaultTransformMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodDelete,
+	http.MethodConnect,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPatch,
+}
+
+// methodMatch is the result of matchMethod.
+type methodMatch int
+
+const (
+	// methodUnknown means more data is needed to tell whether the data starts with a method.
+	methodUnknown methodMatch = iota
+	// methodFound means the data starts with a method followed by a space.
+	methodFound
+	// methodNotFound means the data doesn't start with any of the methods.
+	methodNotFound
+)
+
+// matchMethod reports whether b starts with one of methods followed by a space. If b is too short to
+// tell, methodUnknown is returned.
+func matchMethod(b []byte, methods []string) methodMatch {
+	result := methodNotFound
+	for _, m := range methods {
+		prefix := m + " "
+		switch {
+		case bytes.HasPrefix(b, []byte(prefix)):
+			return methodFound
+		case len(b) < len(prefix) && strings.HasPrefix(prefix, string(b)):
+			result = methodUnknown
+		}
+	}
+
+	return result
+}
+
+// normalizeRequest calls algeneva.NormalizeRequest, converting any panic into an error. Some
+// malformed requests, such as a header without a value, cause algeneva.NormalizeRequest to panic.
+func normalizeRequest(req []byte) (norm []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic normalizing request: %v", r)
+		}
+	}()
+
+	return algeneva.NormalizeRequest(req)
+}
+
+// readDeadliner is implemented by readers whose blocking reads can be interrupted with a deadline,
+// such as net.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// errReadLimit is returned by readAtLeastUntil if the token isn't found within maxBytes.
+var errReadLimit = errors.New("read limit exceeded")
+
 // readAtLeastUntil reads from the provided src Reader until it encounters the specified token,
 // writing the read data to dst. readAtLeastUntil reads and writes in chunks, so dst will also
 // contain all data following token from the last read. If an io.EOF is encountered and the token
 // is found, a nil error is returned and the number of bytes written to dst. Otherwise, the first
 // error encountered will be returned and the number of bytes written to dst up to the point of
-// the error.
-func readAtLeastUntil(src io.Reader, dst io.Writer, token []byte) (int, error) {
+// the error. If maxBytes is greater than zero, the token must end within the first maxBytes bytes;
+// otherwise errReadLimit is returned and the read that would cross the limit is not written. Data
+// following the token in the last read doesn't count against the limit.
+//
+// If ctx is done before the token is found, ctx.Err() is returned. A blocked read is only
+// interrupted if src implements readDeadliner, in which case its read deadline is set to the past;
+// the deadline is never changed after readAtLeastUntil returns.
+func readAtLeastUntil(ctx context.Context, src io.Reader, dst io.Writer, token []byte, maxBytes int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if d, ok := src.(readDeadliner); ok && ctx.Done() != nil {
+		var (
+			mx       sync.Mutex
+			returned bool
+		)
+		stop := context.AfterFunc(ctx, func() {
+			mx.Lock()
+			defer mx.Unlock()
+			if !returned {
+				d.SetReadDeadline(time.Unix(1, 0))
+			}
+		})
+		defer func() {
+			stop()
+			mx.Lock()
+			returned = true
+			mx.Unlock()
+		}()
+	}
+
 	var (
 		// buf is the buffer used for reading data from src.
 		buf = make([]byte, 1024)
@@ -152,11 +938,23 @@ func readAtLeastUntil(src io.Reader, dst io.Writer, token []byte) (int, error) {
 		// Read data from src into buf starting at wptr.
 		nr, er := src.Read(buf[wptr:])
 		if nr > 0 {
+			if maxBytes > 0 && written+nr > maxBytes {
+				// buf[0] is at offset written-wptr in the stream, since buf[:wptr] was already written.
+				i := bytes.Index(buf[:wptr+nr], token)
+				if i < 0 || written-wptr+i+len(token) > maxBytes {
+					return written, fmt.Errorf("%w: token not found in %d bytes", errReadLimit, maxBytes)
+				}
+			}
+
+			// Only the newly read bytes are written; the carried-over bytes in buf[:wptr] were already
+			// written by the previous iteration.
 			nw, ew := dst.Write(buf[wptr : wptr+nr])
 			written += nw
 			wptr += nw
 
 			switch {
+			case er != nil && ctx.Err() != nil:
+				return written, ctx.Err()
 			case er != nil && er != io.EOF:
 				// Error encountered while reading from src and it's not EOF.
 				return written, fmt.Errorf("error reading from src: %w", er)
@@ -178,6 +976,9 @@ func readAtLeastUntil(src io.Reader, dst io.Writer, token []byte) (int, error) {
 		}
 
 		if er != nil {
+			if err := ctx.Err(); err != nil {
+				return written, err
+			}
 			if er == io.EOF {
 				// We reached the end of the src and the token was not found.
 				return written, fmt.Errorf("token not found: %w", io.EOF)
@@ -187,3 +988,121 @@ func readAtLeastUntil(src io.Reader, dst io.Writer, token []byte) (int, error) {
 		}
 	}
 }
+
+// lifetimeConn is a wrapper around a net.Conn that closes the wrapped net.Conn once its lifetime
+// expires.
+type lifetimeConn struct {
+	// Wrapped connection
+	net.Conn
+	// timer closes the wrapped net.Conn once the lifetime expires.
+	timer timer
+}
+
+// newLifetimeConn wraps c in a lifetimeConn that closes c after lifetime has elapsed on clk.
+func newLifetimeConn(c net.Conn, lifetime time.Duration, clk clock) *lifetimeConn {
+	return &lifetimeConn{
+		Conn:  c,
+		timer: clk.AfterFunc(lifetime, func() { c.Close() }),
+	}
+}
+
+// Close closes the wrapped net.Conn and stops the lifetime timer.
+func (lc *lifetimeConn) Close() error {
+	lc.timer.Stop()
+	return lc.Conn.Close()
+}
+
+// boundConn is a wrapper around a net.Conn that closes the wrapped net.Conn when a context is done.
+type boundConn struct {
+	// Wrapped connection
+	net.Conn
+	// stop stops the context watcher.
+	stop func() bool
+}
+
+// newBoundConn wraps c in a boundConn that closes c when ctx is done.
+func newBoundConn(ctx context.Context, c net.Conn) *boundConn {
+	return &boundConn{
+		Conn: c,
+		stop: context.AfterFunc(ctx, func() { c.Close() }),
+	}
+}
+
+// Close closes the wrapped net.Conn and stops watching the context.
+func (bc *boundConn) Close() error {
+	bc.stop()
+	return bc.Conn.Close()
+}
+
+// outcomeConn is a wrapper around a net.Conn that reports whether the connection succeeded, i.e.
+// the first read returned data, or failed.
+type outcomeConn struct {
+	// Wrapped connection
+	net.Conn
+	// report is called once with the outcome of the connection. err is nil on success.
+	report     func(err error)
+	reportOnce sync.Once
+}
+
+// Read reads data from the wrapped net.Conn, reporting the outcome of the connection on the first
+// read that returns data or an error.
+func (oc *outcomeConn) Read(b []byte) (int, error) {
+	n, err := oc.Conn.Read(b)
+	switch {
+	case n > 0:
+		oc.reportOnce.Do(func() { oc.report(nil) })
+	case err != nil:
+		oc.reportOnce.Do(func() { oc.report(err) })
+	}
+
+	return n, err
+}
+
+// Close closes the wrapped net.Conn. If nothing has been read yet, the connection is reported as
+// failed with ErrNoData.
+func (oc *outcomeConn) Close() error {
+	oc.reportOnce.Do(func() { oc.report(ErrNoData) })
+	return oc.Conn.Close()
+}
+
+// jitterConn is a wrapper around a net.Conn that delays each write by a random duration between
+// min and max.
+type jitterConn struct {
+	// Wrapped connection
+	net.Conn
+	min, max time.Duration
+	clock    clock
+	// rand is the source of randomness for the delays.
+	rand io.Reader
+	// mx serializes writes so delayed writes can't be reordered.
+	mx sync.Mutex
+}
+
+func newJitterConn(c net.Conn, min, max time.Duration, clk clock, rand io.Reader) *jitterConn {
+	return &jitterConn{Conn: c, min: min, max: max, clock: clk, rand: rand}
+}
+
+// Write waits for a random delay and then writes b to the wrapped net.Conn.
+func (jc *jitterConn) Write(b []byte) (int, error) {
+	jc.mx.Lock()
+	defer jc.mx.Unlock()
+
+	<-jc.clock.After(jc.delay())
+	return jc.Conn.Write(b)
+}
+
+// delay returns a random duration in [jc.min, jc.max]. If jc.rand fails, jc.max is used so the
+// write is still delayed. It must be called with jc.mx held.
+func (jc *jitterConn) delay() time.Duration {
+	if jc.max <= jc.min {
+		return jc.min
+	}
+
+	var b [8]byte
+	if _, err := io.ReadFull(jc.rand, b[:]); err != nil {
+		return jc.max
+	}
+
+	n := binary.BigEndian.Uint64(b[:]) % uint64(jc.max-jc.min+1)
+	return jc.min + time.Duration(n)
+}
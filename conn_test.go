@@ -2,9 +2,18 @@ package genevahttp
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/getlantern/algeneva"
 	"github.com/stretchr/testify/assert"
@@ -31,7 +40,9 @@ func TestReadAtLeastUntil(t *testing.T) {
 		name       string
 		readerData [][]byte
 		token      []byte
+		maxBytes   int
 		wantBytes  int
+		wantDst    string
 		wantErr    error
 	}{
 		{
@@ -48,6 +59,18 @@ func TestReadAtLeastUntil(t *testing.T) {
 			},
 			token:     []byte("waldo"),
 			wantBytes: 86,
+			wantDst:   "He's gonna be out in the frickin grapes it's he.. -_-GRAPE..GRAPE..GRAwaldoPE..GRAPE..",
+		}, {
+			name: "token split across many reads",
+			readerData: [][]byte{
+				[]byte("GET / HTTP/1.1\r\nHost: example.com\r"),
+				[]byte("\n"),
+				[]byte("\r"),
+				[]byte("\n"),
+			},
+			token:     []byte("\r\n\r\n"),
+			wantBytes: 37,
+			wantDst:   "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
 		}, {
 			name:       "empty src",
 			readerData: [][]byte{},
@@ -60,29 +83,96 @@ func TestReadAtLeastUntil(t *testing.T) {
 			token:      []byte("TOKEN"),
 			wantBytes:  0,
 			wantErr:    io.EOF,
+		}, {
+			name: "limit exceeded before token found",
+			readerData: [][]byte{
+				[]byte("Are we there yet? "),
+				[]byte("No. Are we there yet? "),
+				[]byte("No. Are we there yet? TOKEN"),
+			},
+			token:     []byte("TOKEN"),
+			maxBytes:  32,
+			wantBytes: 18,
+			wantErr:   errReadLimit,
+		}, {
+			name: "data after the token in the last read doesn't count against the limit",
+			readerData: [][]byte{
+				[]byte("Are we there yet? "),
+				[]byte("TOKEN. Finally, let's get out of the car."),
+			},
+			token:     []byte("TOKEN"),
+			maxBytes:  23,
+			wantBytes: 59,
+			wantDst:   "Are we there yet? TOKEN. Finally, let's get out of the car.",
+		}, {
+			name: "token ends past the limit in the last read",
+			readerData: [][]byte{
+				[]byte("Are we there yet? "),
+				[]byte("TOKEN. Finally, let's get out of the car."),
+			},
+			token:     []byte("TOKEN"),
+			maxBytes:  22,
+			wantBytes: 18,
+			wantErr:   errReadLimit,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			var dst bytes.Buffer
 			src := &mockReader{data: tt.readerData}
-			read, err := readAtLeastUntil(src, &dst, tt.token)
+			read, err := readAtLeastUntil(context.Background(), src, &dst, tt.token, tt.maxBytes)
 			if tt.wantErr != nil {
 				assert.ErrorIs(t, err, tt.wantErr)
+				if tt.maxBytes > 0 {
+					assert.Equal(t, tt.wantBytes, read)
+					assert.LessOrEqual(t, dst.Len(), tt.maxBytes)
+				}
 				return
 			}
 
 			assert.NoError(t, err)
 			assert.Equal(t, tt.wantBytes, read)
 			assert.Contains(t, dst.String(), string(tt.token))
+			if tt.wantDst != "" {
+				// Bytes carried over to find a split token must not be written to dst again.
+				assert.Equal(t, tt.wantDst, dst.String())
+			}
 		})
 	}
 }
 
+func TestReadAtLeastUntilCancel(t *testing.T) {
+	src, peer := net.Pipe()
+	defer src.Close()
+	defer peer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		peer.Write([]byte("GET / HTTP/1.1\r\n"))
+		cancel()
+	}()
+
+	var dst bytes.Buffer
+	start := time.Now()
+	read, err := readAtLeastUntil(ctx, src, &dst, []byte("\r\n\r\n"), 0)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 16, read)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", dst.String())
+
+	// The deadline isn't changed after readAtLeastUntil returns, so src is still usable once it's
+	// reset.
+	require.NoError(t, src.SetReadDeadline(time.Time{}))
+	go peer.Write([]byte("ok"))
+	b := make([]byte, 2)
+	_, err = io.ReadFull(src, b)
+	require.NoError(t, err)
+}
+
 func TestHTTPTransformConnShortWrite(t *testing.T) {
 	wrapped, _ := net.Pipe()
 
-	s, err := algeneva.NewHTTPStrategy(algeneva.Strategies["China"][9])
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 9))
 	require.NoError(t, err)
 
 	htc := httpTransformConn{
@@ -90,9 +180,837 @@ func TestHTTPTransformConnShortWrite(t *testing.T) {
 		httpTransform: s,
 	}
 
-	_, err = htc.Write([]byte{'h'})
+	_, err = htc.Write([]byte{'G'})
 	require.NoError(t, err)
 
-	_, err = htc.Write([]byte{'i'})
+	_, err = htc.Write([]byte{'E'})
 	require.NoError(t, err)
 }
+
+type recordingConn struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func TestChunkedConnWrite(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+
+	rc := &recordingConn{}
+	cc := &chunkedConn{Conn: rc, chunkSize: 1024}
+
+	n, err := cc.Write(payload)
+	require.NoError(t, err)
+	assert.Equal(t, len(payload), n)
+
+	require.Len(t, rc.writes, 10)
+	var got []byte
+	for _, w := range rc.writes {
+		assert.LessOrEqual(t, len(w), 1024)
+		got = append(got, w...)
+	}
+	assert.Equal(t, payload, got)
+}
+
+func TestNormalizationConnEmptyNormalization(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	handshakes := &handshakeTracker{}
+	nc := &normalizationConn{
+		Conn:       server,
+		handshakes: handshakes,
+		normalize: func(req []byte) ([]byte, error) {
+			return []byte{}, nil
+		},
+	}
+
+	go client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+
+	_, err := nc.Read(make([]byte, 1024))
+	assert.ErrorIs(t, err, ErrEmptyNormalization)
+
+	// The connection should be closed.
+	_, err = client.Write([]byte("more"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	// The handshake is over, so Shutdown shouldn't wait for it.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, handshakes.wait(ctx))
+}
+
+func TestNormalizationConnMalformedRequest(t *testing.T) {
+	// An empty Host makes algeneva.NormalizeRequest panic, which must not reach the caller.
+	req := []byte("GET / HTTP/1.1\r\nHost:\r\n\r\n")
+	nc := &normalizationConn{Conn: &readerConn{r: bytes.NewReader(req)}}
+
+	var err error
+	require.NotPanics(t, func() { _, err = nc.Read(make([]byte, 1024)) })
+	assert.ErrorIs(t, err, ErrNormalization)
+	assert.ErrorContains(t, err, "panic normalizing request")
+}
+
+func TestHTTPTransformConnSingleWrite(t *testing.T) {
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+	require.NoError(t, err)
+
+	rc := &recordingConn{}
+	htc := httpTransformConn{Conn: rc, httpTransform: s}
+
+	req := []byte("GET /some/path HTTP/1.1\r\nHost: example.com\r\nUser-Agent: test\r\n\r\n")
+	for _, chunk := range [][]byte{req[:10], req[10:30], req[30:]} {
+		_, err := htc.Write(chunk)
+		require.NoError(t, err)
+	}
+
+	want, err := s.Apply(req)
+	require.NoError(t, err)
+	require.Len(t, rc.writes, 1, "transformed request should be written in one call")
+	assert.Equal(t, want, rc.writes[0])
+}
+
+func TestNormalizationConnErrorPhases(t *testing.T) {
+	t.Run("normalization", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		nc := &normalizationConn{Conn: server}
+		go client.Write([]byte("GET\r\n\r\n"))
+
+		_, err := nc.Read(make([]byte, 1024))
+		assert.ErrorIs(t, err, ErrNormalization)
+		assert.NotErrorIs(t, err, ErrConnIO)
+	})
+
+	t.Run("steady state", func(t *testing.T) {
+		client, server := net.Pipe()
+
+		nc := &normalizationConn{Conn: server}
+		go client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+
+		buf := make([]byte, 1024)
+		_, err := nc.Read(buf)
+		require.NoError(t, err)
+
+		server.Close()
+		_, err = nc.Read(buf)
+		assert.ErrorIs(t, err, ErrConnIO)
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+		assert.NotErrorIs(t, err, ErrNormalization)
+	})
+
+	t.Run("EOF", func(t *testing.T) {
+		client, server := net.Pipe()
+
+		nc := &normalizationConn{Conn: server}
+		go func() {
+			client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+			client.Close()
+		}()
+
+		buf := make([]byte, 1024)
+		_, err := nc.Read(buf)
+		require.NoError(t, err)
+
+		_, err = nc.Read(buf)
+		assert.Equal(t, io.EOF, err)
+	})
+}
+
+func TestHTTPTransformConnVerifyTransform(t *testing.T) {
+	req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	tests := []struct {
+		name     string
+		strategy string
+		wantErr  bool
+	}{
+		{name: "valid", strategy: testStrategy(t, "China", 17)},
+		{
+			name:     "request line replaced with CRLF",
+			strategy: "[HTTP:method:*]-replace{%0D%0A:value:1}-|",
+			wantErr:  true,
+		}, {
+			name:     "empty host value",
+			strategy: "[HTTP:host:*]-replace{%0D%0A%0D%0A:value:1}-|",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := algeneva.NewHTTPStrategy(tt.strategy)
+			require.NoError(t, err)
+
+			rc := &recordingConn{}
+			htc := httpTransformConn{Conn: rc, httpTransform: s, verifyTransform: true}
+			_, err = htc.Write(req)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidTransform)
+				assert.Empty(t, rc.writes, "invalid request should not be written")
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Len(t, rc.writes, 1)
+		})
+	}
+}
+
+func TestHTTPTransformConnStreamHeaders(t *testing.T) {
+	strategy := testStrategy(t, "China", 17)
+	require.True(t, requestLineOnly(strategy))
+
+	s, err := algeneva.NewHTTPStrategy(strategy)
+	require.NoError(t, err)
+
+	rc := &recordingConn{}
+	htc := httpTransformConn{Conn: rc, httpTransform: s, streamHeaders: true}
+
+	reqLine := "GET /some/path HTTP/1.1\r\n"
+	headers := "Host: example.com\r\nCookie: " + strings.Repeat("a", 4096) + "\r\n\r\n"
+
+	_, err = htc.Write([]byte(reqLine))
+	require.NoError(t, err)
+	require.Len(t, rc.writes, 1)
+
+	_, err = htc.Write([]byte(headers))
+	require.NoError(t, err)
+
+	want, err := s.Apply([]byte(reqLine + headers))
+	require.NoError(t, err)
+	assert.Equal(t, want, bytes.Join(rc.writes, nil))
+}
+
+// FuzzTransformConnWrite splits a request into arbitrary chunks, writes them to a
+// httpTransformConn, and checks that the transformed request reaching the wire is the same as
+// transforming the whole request at once. Each byte of splits is the length of a chunk, minus one;
+// whatever is left over is written last.
+func FuzzTransformConnWrite(f *testing.F) {
+	requests := []string{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET /some/path?q=1 HTTP/1.1\r\nHost: example.com\r\nUser-Agent: Go-http-client/1.1\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n",
+	}
+	for _, req := range requests {
+		f.Add([]byte(req), []byte{})
+		f.Add([]byte(req), []byte{15})
+		f.Add([]byte(req), []byte{byte(len(req) - 3)})
+		f.Add([]byte(req), bytes.Repeat([]byte{0}, len(req)))
+		f.Add([]byte(req), []byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	}
+	// Requests that don't start with a method are passed through unchanged.
+	f.Add([]byte("  HTTP/1.0\r\n\r\n"), []byte("0"))
+
+	s, err := algeneva.NewHTTPStrategy(testStrategy(f, "China", 17))
+	require.NoError(f, err)
+
+	f.Fuzz(func(t *testing.T, req, splits []byte) {
+		// Only complete requests, i.e. ones that end with the first end of headers, are transformed
+		// in full by the last write. Requests that don't start with one of the transform methods
+		// are written as is.
+		if i := bytes.Index(req, []byte("\r\n\r\n")); i == -1 || i != len(req)-4 {
+			t.Skip()
+		}
+
+		want := req
+		if matchMethod(req, defaultTransformMethods) == methodFound {
+			transformed, err := s.Apply(req)
+			if err != nil {
+				t.Skip()
+			}
+			want = transformed
+		}
+
+		rc := &recordingConn{}
+		htc := httpTransformConn{Conn: rc, httpTransform: s}
+
+		rest := req
+		for _, split := range splits {
+			if len(rest) == 0 {
+				break
+			}
+
+			chunk := rest[:min(int(split)+1, len(rest))]
+			n, err := htc.Write(chunk)
+			require.NoError(t, err)
+			require.Equal(t, len(chunk), n)
+			rest = rest[n:]
+		}
+		if len(rest) > 0 {
+			_, err := htc.Write(rest)
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, want, bytes.Join(rc.writes, nil))
+	})
+}
+
+func TestJitterConn(t *testing.T) {
+	const min, max = 5 * time.Millisecond, 20 * time.Millisecond
+
+	rc := &recordingConn{}
+	jc := newJitterConn(rc, min, max, realClock{}, rand.Reader)
+	for i := 0; i < 1000; i++ {
+		d := jc.delay()
+		require.GreaterOrEqual(t, d, min)
+		require.LessOrEqual(t, d, max)
+	}
+
+	msgs := []string{"one", "two", "three"}
+	for _, msg := range msgs {
+		start := time.Now()
+		n, err := jc.Write([]byte(msg))
+		require.NoError(t, err)
+		assert.Equal(t, len(msg), n)
+		assert.GreaterOrEqual(t, time.Since(start), min, "write should be delayed")
+	}
+
+	require.Len(t, rc.writes, len(msgs))
+	for i, msg := range msgs {
+		assert.Equal(t, msg, string(rc.writes[i]), "writes should be sent in order")
+	}
+}
+
+func TestJitterConnDeterministic(t *testing.T) {
+	const min, max = time.Millisecond, time.Second
+
+	seed := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9}, 100)
+	delays := func() []time.Duration {
+		jc := newJitterConn(nil, min, max, realClock{}, bytes.NewReader(seed))
+		var ds []time.Duration
+		for i := 0; i < 10; i++ {
+			ds = append(ds, jc.delay())
+		}
+		return ds
+	}
+
+	assert.Equal(t, delays(), delays(), "the same random source should produce the same delays")
+}
+
+// syncRecordingConn is a recordingConn that can be written to concurrently and signals each write.
+type syncRecordingConn struct {
+	net.Conn
+	writes chan []byte
+}
+
+func (c *syncRecordingConn) Write(b []byte) (int, error) {
+	c.writes <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func TestHTTPTransformConnHeaderTimeout(t *testing.T) {
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+	require.NoError(t, err)
+
+	clk := newFakeClock()
+	rc := &syncRecordingConn{writes: make(chan []byte, 10)}
+	htc := &httpTransformConn{Conn: rc, httpTransform: s, headerTimeout: time.Second, clock: clk}
+
+	partial := "GET / HTTP/1.1\r\nno end of headers"
+	_, err = htc.Write([]byte(partial))
+	require.NoError(t, err)
+	assert.Empty(t, rc.writes)
+
+	clk.waitForTimers(1)
+	clk.Advance(time.Second)
+
+	select {
+	case w := <-rc.writes:
+		assert.Equal(t, partial, string(w), "buffered data should be flushed as is")
+	case <-time.After(5 * time.Second):
+		t.Fatal("buffered data was not flushed after the header timeout")
+	}
+
+	_, err = htc.Write([]byte("more"))
+	require.NoError(t, err)
+	assert.Equal(t, "more", string(<-rc.writes), "later writes should be forwarded directly")
+}
+
+func TestHTTPTransformConnHeaderTimeoutRequireTransform(t *testing.T) {
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+	require.NoError(t, err)
+
+	clk := newFakeClock()
+	rc := &recordingConn{}
+	cc := &closeCountingConn{Conn: rc}
+	htc := &httpTransformConn{
+		Conn:             cc,
+		httpTransform:    s,
+		headerTimeout:    time.Second,
+		requireTransform: true,
+		clock:            clk,
+	}
+
+	_, err = htc.Write([]byte("GET / HTTP/1.1\r\nno end of headers"))
+	require.NoError(t, err)
+
+	clk.waitForTimers(1)
+	clk.Advance(time.Second)
+	assert.Eventually(t, func() bool { return cc.closes.Load() == 1 }, 5*time.Second, time.Millisecond,
+		"connection should be closed when the header timeout elapses")
+
+	_, err = htc.Write([]byte("\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrFirstRequestNotWritten)
+	assert.ErrorIs(t, err, ErrTransformNoOp)
+	assert.Empty(t, rc.writes, "the request should never be sent untransformed")
+}
+
+func TestHTTPTransformConnMaxRequestBytes(t *testing.T) {
+	req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+	require.NoError(t, err)
+
+	transformed, err := s.Apply(req)
+	require.NoError(t, err)
+
+	rc := &recordingConn{}
+	htc := httpTransformConn{Conn: rc, httpTransform: s, maxRequestBytes: len(transformed) - 1}
+	_, err = htc.Write(req)
+	assert.ErrorIs(t, err, ErrRequestTooLarge)
+	assert.Empty(t, rc.writes, "oversized request should not be written")
+
+	htc = httpTransformConn{Conn: rc, httpTransform: s, maxRequestBytes: len(transformed)}
+	_, err = htc.Write(req)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{transformed}, rc.writes)
+}
+
+func TestTransformNormalizeChunkedBody(t *testing.T) {
+	const (
+		head = "POST /upload HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n\r\n"
+		body = "5\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc123\r\n\r\n"
+	)
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+	require.NoError(t, err)
+
+	// The body may arrive in the same write as the headers or separately, so check the chunk
+	// framing and trailers survive at and around the boundary.
+	for _, split := range []int{len(head), len(head) + 1, len(head) + 3, len(head) + len(body)} {
+		rc := &recordingConn{}
+		htc := httpTransformConn{Conn: rc, httpTransform: s}
+		req := []byte(head + body)
+		_, err := htc.Write(req[:split])
+		require.NoError(t, err)
+		if split < len(req) {
+			_, err = htc.Write(req[split:])
+			require.NoError(t, err)
+		}
+
+		nc := &normalizationConn{Conn: &readerConn{r: &mockReader{data: rc.writes}}}
+		got, err := io.ReadAll(nc)
+		require.NoError(t, err)
+
+		i := bytes.Index(got, []byte("\r\n\r\n"))
+		require.NotEqual(t, -1, i)
+		assert.Equal(t, body, string(got[i+4:]), "split at %d", split)
+	}
+}
+
+func TestHeaderTooLarge(t *testing.T) {
+	const limit = 1024
+	chunk := []byte("X-Padding: " + strings.Repeat("a", 50) + "\r\n")
+
+	t.Run("client", func(t *testing.T) {
+		s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+		require.NoError(t, err)
+
+		rc := &recordingConn{}
+		htc := httpTransformConn{Conn: rc, httpTransform: s, maxHeaderBytes: limit}
+		_, err = htc.Write([]byte("GET / HTTP/1.1\r\n"))
+		require.NoError(t, err)
+		_, err = htc.Write(bytes.Repeat(chunk, limit/len(chunk)))
+		require.NoError(t, err, "headers within the limit should be buffered")
+
+		_, err = htc.Write(chunk)
+		assert.ErrorIs(t, err, ErrHeaderTooLarge)
+		assert.Empty(t, rc.writes)
+	})
+
+	t.Run("server", func(t *testing.T) {
+		data := [][]byte{[]byte("GET / HTTP/1.1\r\n")}
+		for i := 0; i < 2*limit/len(chunk); i++ {
+			data = append(data, chunk)
+		}
+
+		nc := &normalizationConn{Conn: &readerConn{r: &mockReader{data: data}}, maxHeaderBytes: limit}
+		_, err := nc.Read(make([]byte, 1024))
+		assert.ErrorIs(t, err, ErrHeaderTooLarge)
+	})
+
+	t.Run("server with pipelined body", func(t *testing.T) {
+		// The headers fit within the limit, but the body arriving in the same read doesn't.
+		req := "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 512\r\n\r\n"
+		body := strings.Repeat("b", 512)
+		nc := &normalizationConn{
+			Conn:           &readerConn{r: strings.NewReader(req + body)},
+			maxHeaderBytes: len(req),
+		}
+
+		got, err := io.ReadAll(nc)
+		require.NoError(t, err)
+		assert.True(t, strings.HasSuffix(string(got), "\r\n\r\n"+body), "body should follow the normalized headers")
+	})
+}
+
+func TestNormalizationConnFirstRequestTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	t.Run("slow client", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		nc := &normalizationConn{Conn: server, firstRequestTimeout: timeout}
+		defer nc.Close()
+
+		// Trickle the request in one byte at a time so the headers aren't complete in time.
+		go func() {
+			for _, b := range req {
+				if _, err := client.Write([]byte{b}); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+
+		_, err := nc.Read(make([]byte, 1024))
+		assert.ErrorIs(t, err, ErrFirstRequestTimeout)
+	})
+
+	t.Run("deadline cleared", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		nc := &normalizationConn{Conn: server, firstRequestTimeout: timeout}
+		defer nc.Close()
+
+		go func() {
+			client.Write(req)
+			time.Sleep(2 * timeout)
+			client.Write([]byte("ping"))
+		}()
+
+		got, err := io.ReadAll(io.LimitReader(nc, int64(len(req)+4)))
+		require.NoError(t, err, "later reads should not be affected by the timeout")
+		assert.Equal(t, string(req)+"ping", string(got))
+	})
+}
+
+func TestNormalizationConnOnNormalize(t *testing.T) {
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+	require.NoError(t, err)
+
+	req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	transformed, err := s.Apply(req)
+	require.NoError(t, err)
+
+	var gotOriginal, gotNormalized []byte
+	nc := &normalizationConn{
+		Conn: &readerConn{r: bytes.NewReader(transformed)},
+		onNormalize: func(original, normalized []byte) {
+			gotOriginal, gotNormalized = original, normalized
+		},
+	}
+	got, err := io.ReadAll(nc)
+	require.NoError(t, err)
+
+	assert.Equal(t, transformed, gotOriginal)
+	assert.Equal(t, got, gotNormalized)
+
+	nc = &normalizationConn{
+		Conn:        &readerConn{r: strings.NewReader("GET\r\n\r\n")},
+		onNormalize: func(original, normalized []byte) { gotOriginal, gotNormalized = original, normalized },
+	}
+	_, err = nc.Read(make([]byte, 1024))
+	require.Error(t, err)
+	assert.Equal(t, "GET\r\n\r\n", string(gotOriginal))
+	assert.Nil(t, gotNormalized, "normalized should be nil if normalization failed")
+}
+
+func TestNormalizationConnFirstReadCoalesced(t *testing.T) {
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+	require.NoError(t, err)
+
+	req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nUser-Agent: test\r\nUpgrade: websocket\r\n\r\n")
+	transformed, err := s.Apply(req)
+	require.NoError(t, err)
+
+	// Deliver the transformed request in several reads; the normalized request should still be
+	// returned by a single Read if b is large enough.
+	data := [][]byte{transformed[:10], transformed[10:30], transformed[30:]}
+	nc := &normalizationConn{Conn: &readerConn{r: &mockReader{data: data}}}
+
+	b := make([]byte, 4096)
+	n, err := nc.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, string(req), string(b[:n]))
+}
+
+func TestHTTPTransformConnWriteAccounting(t *testing.T) {
+	// The strategy replaces the request-line with CRLF, which can't be normalized.
+	s, err := algeneva.NewHTTPStrategy("[HTTP:method:*]-replace{%0D%0A:value:1}-|")
+	require.NoError(t, err)
+
+	rc := &recordingConn{}
+	htc := httpTransformConn{Conn: rc, httpTransform: s, verifyTransform: true}
+
+	head := []byte("GET / HTTP/1.1\r\n")
+	n, err := htc.Write(head)
+	require.NoError(t, err, "incomplete headers should be buffered")
+	assert.Equal(t, len(head), n)
+	assert.Equal(t, len(head), htc.buf.Len())
+
+	n, err = htc.Write([]byte("Host: example.com\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrFirstRequestNotWritten)
+	assert.ErrorIs(t, err, ErrInvalidTransform)
+	assert.Zero(t, n, "bytes that failed to transform should not be reported as written")
+	assert.Equal(t, len(head), htc.buf.Len(), "only the failed write should be dropped")
+	assert.Empty(t, rc.writes)
+}
+
+func TestHTTPTransformConnByteAtATime(t *testing.T) {
+	req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n")
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+	require.NoError(t, err)
+
+	want, err := s.Apply(req)
+	require.NoError(t, err)
+
+	var transforms int
+	rc := &recordingConn{}
+	htc := httpTransformConn{
+		Conn:          rc,
+		httpTransform: s,
+		onTransform:   func(ctx context.Context, req, transformed []byte) { transforms++ },
+	}
+	for _, b := range req {
+		n, err := htc.Write([]byte{b})
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+	}
+
+	assert.Equal(t, 1, transforms, "the transform should fire exactly once")
+	assert.Equal(t, [][]byte{want}, rc.writes)
+}
+
+// fragment splits b into chunks of at most n bytes.
+func fragment(b []byte, n int) [][]byte {
+	var chunks [][]byte
+	for len(b) > n {
+		chunks = append(chunks, b[:n])
+		b = b[n:]
+	}
+	return append(chunks, b)
+}
+
+func TestFirstRequestFragmented(t *testing.T) {
+	req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n")
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+	require.NoError(t, err)
+
+	for _, size := range []int{1, 2, 7} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			rc := &recordingConn{}
+			htc := httpTransformConn{Conn: rc, httpTransform: s}
+			for _, f := range fragment(req, size) {
+				_, err := htc.Write(f)
+				require.NoError(t, err)
+			}
+			require.Len(t, rc.writes, 1, "the request should be transformed as a whole")
+
+			nc := &normalizationConn{Conn: &readerConn{r: &mockReader{data: fragment(rc.writes[0], size)}}}
+			b := make([]byte, 4096)
+			n, err := nc.Read(b)
+			require.NoError(t, err)
+			assert.Equal(t, string(req), string(b[:n]))
+		})
+	}
+}
+
+// closeCountingConn is a net.Conn that counts calls to Close.
+type closeCountingConn struct {
+	net.Conn
+	closes atomic.Int32
+}
+
+func (c *closeCountingConn) Close() error {
+	c.closes.Add(1)
+	return nil
+}
+
+func TestLifetimeConn(t *testing.T) {
+	t.Run("expires", func(t *testing.T) {
+		clk := newFakeClock()
+		cc := &closeCountingConn{}
+		newLifetimeConn(cc, time.Hour, clk)
+
+		clk.Advance(time.Hour)
+		assert.Eventually(t, func() bool {
+			return cc.closes.Load() == 1
+		}, 5*time.Second, time.Millisecond, "connection should be closed after its lifetime")
+	})
+	t.Run("closed early", func(t *testing.T) {
+		clk := newFakeClock()
+		cc := &closeCountingConn{}
+		lc := newLifetimeConn(cc, time.Hour, clk)
+
+		require.NoError(t, lc.Close())
+		clk.Advance(time.Hour)
+		assert.Equal(t, int32(1), cc.closes.Load(), "timer should be stopped on Close")
+	})
+}
+
+func BenchmarkLifetimeConnGoroutines(b *testing.B) {
+	conns := make([]*lifetimeConn, b.N)
+	before := runtime.NumGoroutine()
+	for i := range conns {
+		conns[i] = newLifetimeConn(&closeCountingConn{}, time.Hour, realClock{})
+	}
+	b.ReportMetric(float64(runtime.NumGoroutine()-before)/float64(b.N), "goroutines/conn")
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func TestMatchMethod(t *testing.T) {
+	methods := []string{"GET", "POST"}
+	tests := []struct {
+		data string
+		want methodMatch
+	}{
+		{data: "GET / HTTP/1.1\r\n", want: methodFound},
+		{data: "POST ", want: methodFound},
+		{data: "G", want: methodUnknown},
+		{data: "POS", want: methodUnknown},
+		{data: "GET", want: methodUnknown},
+		{data: "GETX / HTTP/1.1\r\n", want: methodNotFound},
+		{data: "get / HTTP/1.1\r\n", want: methodNotFound},
+		{data: "PRI * HTTP/2.0\r\n", want: methodNotFound},
+		{data: "\x16\x03\x01", want: methodNotFound},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, matchMethod([]byte(tt.data), methods), "%q", tt.data)
+	}
+}
+
+func TestHTTPTransformConnTransformedFirstRequest(t *testing.T) {
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+	require.NoError(t, err)
+
+	t.Run("transformed", func(t *testing.T) {
+		htc := &httpTransformConn{Conn: &recordingConn{}, httpTransform: s}
+		assert.False(t, htc.TransformedFirstRequest(), "nothing has been written yet")
+
+		_, err := htc.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		require.NoError(t, err)
+		assert.True(t, htc.TransformedFirstRequest())
+	})
+
+	t.Run("incomplete headers flushed", func(t *testing.T) {
+		var logs syncBuffer
+		clk := newFakeClock()
+		rc := &syncRecordingConn{writes: make(chan []byte, 10)}
+		htc := &httpTransformConn{
+			Conn:          rc,
+			httpTransform: s,
+			headerTimeout: time.Second,
+			clock:         clk,
+			logger:        slog.New(slog.NewTextHandler(&logs, nil)),
+		}
+
+		_, err := htc.Write([]byte("GET / HTTP/1.1\r\nno end of headers"))
+		require.NoError(t, err)
+		clk.waitForTimers(1)
+		clk.Advance(time.Second)
+		<-rc.writes
+
+		assert.False(t, htc.TransformedFirstRequest())
+		assert.Contains(t, logs.String(), `level=WARN msg="genevahttp: first request sent untransformed"`)
+		assert.Contains(t, logs.String(), `reason="headers not complete within 1s"`)
+	})
+
+	t.Run("no transform method", func(t *testing.T) {
+		var logs syncBuffer
+		htc := &httpTransformConn{
+			Conn:          &recordingConn{},
+			httpTransform: s,
+			logger:        slog.New(slog.NewTextHandler(&logs, nil)),
+		}
+
+		_, err := htc.Write([]byte("\x16\x03\x01"))
+		require.NoError(t, err)
+		assert.False(t, htc.TransformedFirstRequest())
+		assert.Contains(t, logs.String(), `reason="first write doesn't start with a transform method"`)
+	})
+}
+
+func TestHTTPTransformConnTransformMethods(t *testing.T) {
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+	require.NoError(t, err)
+
+	t.Run("non-method first write is passed through", func(t *testing.T) {
+		rc := &recordingConn{}
+		htc := &httpTransformConn{Conn: rc, httpTransform: s}
+		preface := "PRI * HTTP/2.0\r\n"
+		_, err := htc.Write([]byte(preface))
+		require.NoError(t, err)
+		require.Len(t, rc.writes, 1, "first write should not be buffered")
+		assert.Equal(t, preface, string(rc.writes[0]))
+
+		req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		_, err = htc.Write([]byte(req))
+		require.NoError(t, err)
+		assert.Equal(t, req, string(rc.writes[1]), "later writes should be forwarded directly")
+	})
+	t.Run("custom methods", func(t *testing.T) {
+		rc := &recordingConn{}
+		htc := &httpTransformConn{Conn: rc, httpTransform: s, methods: []string{http.MethodPost}}
+		req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		_, err := htc.Write([]byte(req))
+		require.NoError(t, err)
+		require.Len(t, rc.writes, 1)
+		assert.Equal(t, req, string(rc.writes[0]), "request with another method should not be transformed")
+	})
+	t.Run("split method is buffered", func(t *testing.T) {
+		rc := &recordingConn{}
+		htc := &httpTransformConn{Conn: rc, httpTransform: s}
+		_, err := htc.Write([]byte("GE"))
+		require.NoError(t, err)
+		assert.Empty(t, rc.writes)
+
+		_, err = htc.Write([]byte("T / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		require.NoError(t, err)
+		require.Len(t, rc.writes, 1)
+		assert.NotEqual(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", string(rc.writes[0]),
+			"request should be transformed")
+	})
+	t.Run("require transform", func(t *testing.T) {
+		rc := &recordingConn{}
+		htc := &httpTransformConn{Conn: rc, httpTransform: s, requireTransform: true}
+		_, err := htc.Write([]byte("PRI * HTTP/2.0\r\n"))
+		assert.ErrorIs(t, err, ErrTransformNoOp)
+		assert.Empty(t, rc.writes)
+	})
+}
+
+func TestNewNormalizationConnPrebuffered(t *testing.T) {
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	transformed, err := TransformRequest(testStrategy(t, "China", 17), []byte(req))
+	require.NoError(t, err)
+	want, err := algeneva.NormalizeRequest(transformed)
+	require.NoError(t, err)
+
+	for _, split := range []int{1, 10, len(transformed) - 1, len(transformed)} {
+		prebuffered, rest := transformed[:split], transformed[split:]
+		nc := newNormalizationConn(&readerConn{r: bytes.NewReader(rest)}, prebuffered)
+
+		got, err := io.ReadAll(nc)
+		require.NoError(t, err, "split at %d", split)
+		assert.Equal(t, string(want), string(got), "split at %d", split)
+	}
+}
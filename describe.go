@@ -0,0 +1,176 @@
+package genevahttp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// String renders the effective configuration for logging. Options left at their zero value are
+// omitted unless they have a non-zero default, callbacks and interfaces are only reported as set,
+// and key material, such as TLS certificates, is redacted.
+func (opts DialerOpts) String() string {
+	d := describer{name: "DialerOpts"}
+	d.str("AlgenevaStrategy", opts.AlgenevaStrategy)
+	if len(opts.AlgenevaStrategies) > 0 {
+		d.field("AlgenevaStrategies", fmt.Sprintf("%q", opts.AlgenevaStrategies))
+	}
+	d.set("StrategySelector", opts.StrategySelector != nil)
+	if len(opts.FallbackStrategies) > 0 {
+		d.field("FallbackStrategies", fmt.Sprintf("%q", opts.FallbackStrategies))
+	}
+	d.set("Dialer", opts.Dialer != nil)
+	d.tlsConfig("TLSConfig", opts.TLSConfig)
+	d.int("ReadBufferSize", opts.ReadBufferSize)
+	d.int("WriteBufferSize", opts.WriteBufferSize)
+	d.set("SessionCache", opts.SessionCache != nil)
+	d.int("WriteChunkSize", opts.WriteChunkSize)
+	d.set("OnTransform", opts.OnTransform != nil)
+	d.bool("RequireTransform", opts.RequireTransform)
+	d.bool("VerifyTransform", opts.VerifyTransform)
+	d.bool("StreamHeaders", opts.StreamHeaders)
+	d.dur("WriteJitterMin", opts.WriteJitterMin)
+	d.dur("WriteJitterMax", opts.WriteJitterMax)
+	d.intOrDefault("MaxHeaderBytes", opts.MaxHeaderBytes, DefaultMaxHeaderBytes)
+	d.int("MaxRequestBytes", opts.MaxRequestBytes)
+	d.dur("HeaderTimeout", opts.HeaderTimeout)
+	if len(opts.TransformMethods) > 0 {
+		d.field("TransformMethods", fmt.Sprintf("%q", opts.TransformMethods))
+	}
+	d.set("WSTransport", opts.WSTransport != nil)
+	d.compressionMode("CompressionMode", opts.CompressionMode)
+	d.str("WSPath", opts.WSPath)
+	d.str("WSHost", opts.WSHost)
+	d.dur("MaxConnLifetime", opts.MaxConnLifetime)
+	d.dur("KeepAlive", opts.KeepAlive)
+	d.set("OnOutcome", opts.OnOutcome != nil)
+	d.bool("OutcomeOnHandshake", opts.OutcomeOnHandshake)
+	d.set("Rand", opts.Rand != nil)
+	d.set("Histograms", opts.Histograms != nil)
+	d.set("Metrics", opts.Metrics != nil)
+	d.set("Logger", opts.Logger != nil)
+	return d.String()
+}
+
+// String renders the effective configuration for logging. See DialerOpts.String.
+func (opts WrapListenerOpts) String() string {
+	d := describer{name: "WrapListenerOpts"}
+	d.tlsConfig("TLSConfig", opts.TLSConfig)
+	d.set("WSTransport", opts.WSTransport != nil)
+	d.compressionMode("CompressionMode", opts.CompressionMode)
+	if len(opts.AllowedHosts) > 0 {
+		d.field("AllowedHosts", fmt.Sprintf("%q", opts.AllowedHosts))
+	}
+	if rl := opts.PerIPRateLimit; rl.Connections > 0 && rl.Window > 0 {
+		d.field("PerIPRateLimit", fmt.Sprintf("%d/%s", rl.Connections, rl.Window))
+	}
+	d.dur("BusyTimeout", opts.BusyTimeout)
+	d.bool("PoolBuffers", opts.PoolBuffers)
+	d.int("MaxBuffers", opts.MaxBuffers)
+	d.intOrDefault("MaxHeaderBytes", opts.MaxHeaderBytes, DefaultMaxHeaderBytes)
+	d.dur("AcceptTimeout", opts.AcceptTimeout)
+	d.dur("KeepAlive", opts.KeepAlive)
+	d.dur("FirstRequestTimeout", opts.FirstRequestTimeout)
+	d.set("OnNormalize", opts.OnNormalize != nil)
+	d.set("Metrics", opts.Metrics != nil)
+	d.set("Logger", opts.Logger != nil)
+	return d.String()
+}
+
+// describer renders a struct as "name{field=value, ...}".
+type describer struct {
+	name   string
+	fields []string
+}
+
+func (d *describer) field(name, value string) {
+	d.fields = append(d.fields, name+"="+value)
+}
+
+func (d *describer) str(name, v string) {
+	if v != "" {
+		d.field(name, fmt.Sprintf("%q", v))
+	}
+}
+
+func (d *describer) int(name string, v int) {
+	if v != 0 {
+		d.field(name, fmt.Sprint(v))
+	}
+}
+
+func (d *describer) intOrDefault(name string, v, def int) {
+	if v <= 0 {
+		v = def
+	}
+	d.field(name, fmt.Sprint(v))
+}
+
+func (d *describer) dur(name string, v time.Duration) {
+	if v != 0 {
+		d.field(name, v.String())
+	}
+}
+
+func (d *describer) bool(name string, v bool) {
+	if v {
+		d.field(name, "true")
+	}
+}
+
+func (d *describer) set(name string, v bool) {
+	if v {
+		d.field(name, "set")
+	}
+}
+
+func (d *describer) compressionMode(name string, m websocket.CompressionMode) {
+	switch m {
+	case websocket.CompressionDisabled:
+	case websocket.CompressionContextTakeover:
+		d.field(name, "ContextTakeover")
+	case websocket.CompressionNoContextTakeover:
+		d.field(name, "NoContextTakeover")
+	default:
+		d.field(name, fmt.Sprint(int(m)))
+	}
+}
+
+// tlsConfig renders the options of cfg that affect the handshake. Certificates and session ticket
+// keys are redacted.
+func (d *describer) tlsConfig(name string, cfg *tls.Config) {
+	if cfg == nil {
+		return
+	}
+
+	td := describer{}
+	td.str("ServerName", cfg.ServerName)
+	td.bool("InsecureSkipVerify", cfg.InsecureSkipVerify)
+	if cfg.MinVersion != 0 {
+		td.field("MinVersion", tls.VersionName(cfg.MinVersion))
+	}
+	if cfg.MaxVersion != 0 {
+		td.field("MaxVersion", tls.VersionName(cfg.MaxVersion))
+	}
+	if len(cfg.NextProtos) > 0 {
+		td.field("NextProtos", fmt.Sprintf("%q", cfg.NextProtos))
+	}
+	if len(cfg.Certificates) > 0 {
+		td.field("Certificates", fmt.Sprintf("[%d redacted]", len(cfg.Certificates)))
+	}
+	td.set("GetCertificate", cfg.GetCertificate != nil)
+	td.set("RootCAs", cfg.RootCAs != nil)
+	td.set("ClientCAs", cfg.ClientCAs != nil)
+	td.set("ClientSessionCache", cfg.ClientSessionCache != nil)
+	if cfg.SessionTicketKey != [32]byte{} {
+		td.field("SessionTicketKey", "redacted")
+	}
+	d.field(name, td.String())
+}
+
+func (d describer) String() string {
+	return d.name + "{" + strings.Join(d.fields, ", ") + "}"
+}
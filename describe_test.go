@@ -0,0 +1,49 @@
+package genevahttp
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"nhooyr.io/websocket"
+)
+
+func TestOptsString(t *testing.T) {
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	require.NoError(t, err)
+	tlsConfig := &tls.Config{
+		ServerName:       "example.com",
+		Certificates:     []tls.Certificate{cert},
+		SessionTicketKey: [32]byte{1, 2, 3},
+	}
+
+	opts := DialerOpts{
+		AlgenevaStrategy: "[HTTP:method:*]-insert{%20:start:value:1}-|",
+		TLSConfig:        tlsConfig,
+		RequireTransform: true,
+		MaxConnLifetime:  time.Hour,
+	}
+	assert.Equal(t,
+		`DialerOpts{AlgenevaStrategy="[HTTP:method:*]-insert{%20:start:value:1}-|", `+
+			`TLSConfig={ServerName="example.com", Certificates=[1 redacted], SessionTicketKey=redacted}, `+
+			`RequireTransform=true, MaxHeaderBytes=65536, MaxConnLifetime=1h0m0s}`,
+		opts.String(),
+	)
+
+	lopts := WrapListenerOpts{
+		TLSConfig:       tlsConfig,
+		AllowedHosts:    []string{"*.example.com"},
+		PerIPRateLimit:  RateLimit{Connections: 10, Window: time.Minute},
+		OnNormalize:     func(original, normalized []byte) {},
+		CompressionMode: websocket.CompressionNoContextTakeover,
+	}
+	s := lopts.String()
+	assert.Contains(t, s, `AllowedHosts=["*.example.com"]`)
+	assert.Contains(t, s, "PerIPRateLimit=10/1m0s")
+	assert.Contains(t, s, "OnNormalize=set")
+	assert.Contains(t, s, "CompressionMode=NoContextTakeover")
+	assert.NotContains(t, s, "PRIVATE KEY")
+	assert.NotContains(t, s, "[1 2 3", "session ticket key should be redacted")
+}
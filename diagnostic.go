@@ -0,0 +1,189 @@
+package genevahttp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Phases of a dial reported by DialDiagnostic, in the order they are attempted.
+const (
+	PhaseDNS       = "dns"
+	PhaseTCP       = "tcp"
+	PhaseWebsocket = "websocket"
+	PhaseTLS       = "tls"
+)
+
+// errPhaseSkipped is the error reported for a phase that was not attempted because a phase it
+// depends on failed.
+var errPhaseSkipped = errors.New("skipped due to an earlier failure")
+
+// PhaseResult is the result of a single phase of a dial.
+type PhaseResult struct {
+	// Phase is the name of the phase, e.g. PhaseTCP.
+	Phase string
+	// Duration is how long the phase took.
+	Duration time.Duration
+	// Err is the error encountered during the phase, or nil if it succeeded.
+	Err error
+	// Skipped reports whether the phase was not attempted because an earlier phase it depends on
+	// failed.
+	Skipped bool
+}
+
+// DiagnosticReport describes the outcome of each phase of a dial made by DialDiagnostic.
+type DiagnosticReport struct {
+	// Phases contains the result of each phase in the order they were attempted.
+	Phases []PhaseResult
+}
+
+// Failed returns the result of the first phase that failed, or nil if all phases succeeded.
+func (r DiagnosticReport) Failed() *PhaseResult {
+	for i, p := range r.Phases {
+		if p.Err != nil && !p.Skipped {
+			return &r.Phases[i]
+		}
+	}
+
+	return nil
+}
+
+// String returns a human readable summary of the report with one line per phase.
+func (r DiagnosticReport) String() string {
+	var sb strings.Builder
+	for _, p := range r.Phases {
+		switch {
+		case p.Skipped:
+			fmt.Fprintf(&sb, "%s: skipped\n", p.Phase)
+		case p.Err != nil:
+			fmt.Fprintf(&sb, "%s: failed after %s: %v\n", p.Phase, p.Duration, p.Err)
+		default:
+			fmt.Fprintf(&sb, "%s: ok in %s\n", p.Phase, p.Duration)
+		}
+	}
+
+	return sb.String()
+}
+
+// DialDiagnostic attempts each phase of DialContext (DNS lookup, TCP connect, websocket upgrade,
+// and TLS handshake) separately and reports the outcome and duration of each one. Phases that
+// depend on a failed phase are reported as skipped. The TLS phase is only attempted if
+// opts.TLSConfig is not nil. DialDiagnostic is meant for troubleshooting;
+// the connection it establishes is closed before it returns.
+func DialDiagnostic(ctx context.Context, network, address string, opts DialerOpts) DiagnosticReport {
+	opts = opts.selectStrategy()
+	var report DiagnosticReport
+	clk := opts.getClock()
+	run := func(phase string, fn func() error) bool {
+		start := clk.Now()
+		err := fn()
+		report.Phases = append(report.Phases, PhaseResult{
+			Phase:    phase,
+			Duration: clk.Since(start),
+			Err:      err,
+		})
+		return err == nil
+	}
+	skip := func(phases ...string) DiagnosticReport {
+		for _, phase := range phases {
+			if phase == PhaseTLS && opts.TLSConfig == nil {
+				continue
+			}
+			report.Phases = append(report.Phases, PhaseResult{
+				Phase:   phase,
+				Err:     errPhaseSkipped,
+				Skipped: true,
+			})
+		}
+		return report
+	}
+
+	// The DNS phase is informational; a custom Dialer may resolve the address itself (e.g. through a
+	// proxy), so we continue to the TCP phase even if the lookup fails.
+	run(PhaseDNS, func() error {
+		if err := validateAddress(address); err != nil {
+			return err
+		}
+
+		host, _, _ := net.SplitHostPort(address)
+		_, err := net.DefaultResolver.LookupHost(ctx, host)
+		return err
+	})
+
+	dialer := baseDialer(opts)
+
+	var cc net.Conn
+	if !run(PhaseTCP, func() (err error) {
+		if network, err = validateNetwork(network); err != nil {
+			return err
+		}
+
+		cc, err = dialer.DialContext(ctx, network, address)
+		return err
+	}) {
+		return skip(PhaseWebsocket, PhaseTLS)
+	}
+
+	transport := opts.WSTransport
+	if transport == nil {
+		transport = nhooyrTransport{compressionMode: opts.CompressionMode}
+	}
+
+	// Hand the already established connection to the websocket client so the upgrade is timed
+	// separately from the TCP connect.
+	used := false
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				if used {
+					return nil, errors.New("connection already used")
+				}
+				used = true
+				return newHTTPTransformConn(ctx, cc, opts), nil
+			},
+		},
+	}
+
+	var conn net.Conn
+	if !run(PhaseWebsocket, func() (err error) {
+		// The strategy is applied to the upgrade request, so a bad strategy is reported as part of
+		// this phase.
+		if opts.AlgenevaStrategy != "" {
+			opts.strategy, err = compileStrategy(opts.AlgenevaStrategy)
+			if err != nil {
+				return fmt.Errorf("failed to create geneva strategy: %w", err)
+			}
+		}
+		if opts.strategy == nil && opts.RequireTransform {
+			return fmt.Errorf("%w: no strategy configured", ErrTransformNoOp)
+		}
+
+		url, err := wsURL(address, opts)
+		if err != nil {
+			return err
+		}
+
+		conn, err = transport.Dial(ctx, url, client)
+		return err
+	}) {
+		cc.Close()
+		return skip(PhaseTLS)
+	}
+
+	defer conn.Close()
+	if opts.TLSConfig == nil {
+		return report
+	}
+
+	run(PhaseTLS, func() error {
+		tlsConn := tls.Client(conn, clientTLSConfig(opts))
+		return tlsConn.HandshakeContext(ctx)
+	})
+
+	return report
+}
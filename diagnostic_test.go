@@ -0,0 +1,86 @@
+package genevahttp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialDiagnostic(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer ll.Close()
+
+	go func() {
+		for {
+			c, err := ll.Accept()
+			if err != nil {
+				return
+			}
+
+			// Read to drive the server side of the TLS handshake.
+			go func() {
+				defer c.Close()
+				c.Read(make([]byte, 1))
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The client doesn't trust the server's self-signed certificate, so the TLS phase should fail.
+	opts := DialerOpts{
+		AlgenevaStrategy: testStrategy(t, "China", 17),
+		TLSConfig:        &tls.Config{ServerName: "localhost"},
+	}
+	report := DialDiagnostic(ctx, "tcp", l.Addr().String(), opts)
+	require.Len(t, report.Phases, 4, report.String())
+
+	failed := report.Failed()
+	require.NotNil(t, failed, report.String())
+	assert.Equal(t, PhaseTLS, failed.Phase)
+	for _, p := range report.Phases[:3] {
+		assert.NoError(t, p.Err, "phase %s", p.Phase)
+	}
+}
+
+func TestDialDiagnosticConnectFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	report := DialDiagnostic(context.Background(), "tcp", addr, DialerOpts{})
+	require.Len(t, report.Phases, 3, report.String())
+
+	failed := report.Failed()
+	require.NotNil(t, failed, report.String())
+	assert.Equal(t, PhaseTCP, failed.Phase)
+	assert.True(t, report.Phases[2].Skipped)
+}
+
+func TestDialDiagnosticRequireTransformWithoutStrategy(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+	go acceptAndClose(ll)
+
+	report := DialDiagnostic(context.Background(), "tcp", l.Addr().String(), DialerOpts{RequireTransform: true})
+	failed := report.Failed()
+	require.NotNil(t, failed, report.String())
+	assert.Equal(t, PhaseWebsocket, failed.Phase)
+	assert.ErrorIs(t, failed.Err, ErrTransformNoOp)
+}
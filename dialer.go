@@ -2,15 +2,37 @@ package genevahttp
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/getlantern/algeneva"
 	"nhooyr.io/websocket"
 )
 
+var (
+	// ErrInvalidAddress is returned when the address passed to Dial or DialContext is not in the
+	// form "host:port".
+	ErrInvalidAddress = errors.New("invalid address")
+	// ErrInvalidWSPath is returned when DialerOpts.WSPath doesn't begin with "/".
+	ErrInvalidWSPath = errors.New("invalid websocket path")
+	// ErrUnsupportedNetwork is returned when the network passed to Dial or DialContext is not one
+	// of "tcp", "tcp4", or "tcp6".
+	ErrUnsupportedNetwork = errors.New("unsupported network")
+)
+
+// defaultSessionCache is the TLS session cache used when neither DialerOpts.SessionCache nor
+// DialerOpts.TLSConfig.ClientSessionCache is set. It is shared by all connections so that TLS
+// sessions can be resumed on reconnect.
+var defaultSessionCache = tls.NewLRUClientSessionCache(0)
+
 // Dialer is the interface used to establish connections to the server.
 type Dialer interface {
 	Dial(network, address string) (net.Conn, error)
@@ -22,53 +44,327 @@ type DialerOpts struct {
 	// AlgenevaStrategy is the geneva HTTPStrategy to apply to the connect request.
 	AlgenevaStrategy string
 	strategy         *algeneva.HTTPStrategy
+	// AlgenevaStrategies, if not empty, is a list of geneva strategies to rotate among, which makes
+	// the connections harder for an adaptive censor to learn. Each dial uses the strategy picked by
+	// StrategySelector in place of AlgenevaStrategy. Only the picked strategy is compiled, so a dial
+	// costs the same as with a single strategy.
+	AlgenevaStrategies []string
+	// StrategySelector picks the strategy each dial uses from AlgenevaStrategies. If nil,
+	// RandomSelector is used.
+	StrategySelector StrategySelector
+	// FallbackStrategies, if not empty, are tried in order if the dial with AlgenevaStrategy fails,
+	// e.g. because a censor has learned it, until one succeeds or the context is done. OnOutcome is
+	// called for each strategy tried, so it reports which one succeeded. If they all fail, the
+	// error wraps ErrNoWorkingStrategy and the error of each attempt.
+	FallbackStrategies []string
 	// Dialer is the dialer used to connect to the server. If AlgenevaStrategy is not empty, the
 	// strategy will be applied to the request made by Dialer.Dial for all connections. If nil, the
 	// default dialer is used.
 	Dialer    Dialer
 	TLSConfig *tls.Config
+	// ReadBufferSize and WriteBufferSize set the size of the socket's receive and send buffers
+	// (SO_RCVBUF and SO_SNDBUF) before connecting. Larger buffers can improve throughput on links with
+	// a high bandwidth-delay product. They are only used with the default dialer, i.e. if Dialer is
+	// nil, and are applied on a best-effort basis. If zero, the system defaults are used.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// SessionCache is the cache used to resume TLS sessions on reconnect. It is only used if
+	// TLSConfig is not nil and TLSConfig.ClientSessionCache is nil. If nil, a default LRU cache
+	// shared by all connections is used.
+	SessionCache tls.ClientSessionCache
+	// WriteChunkSize is the maximum number of bytes sent in a single websocket message. Writes larger
+	// than WriteChunkSize are split across multiple messages, which avoids sending large,
+	// distinctive frames and hitting the peer's read limit. If zero, writes are not split.
+	WriteChunkSize int
+	// OnTransform, if not nil, is called with the original and transformed connect request after the
+	// geneva strategy is applied. ctx is the context passed to DialContext, so callers can use it to
+	// pass per-connection values, such as a request ID, to the hook.
+	OnTransform func(ctx context.Context, req, transformed []byte)
+	// RequireTransform causes the dial to fail with ErrTransformNoOp if the geneva strategy does not
+	// modify the connect request, rather than sending the request un-obfuscated. The dial also fails
+	// if no strategy is configured.
+	RequireTransform bool
+	// VerifyTransform causes the dial to fail with ErrInvalidTransform if the connect request can't
+	// be normalized after the geneva strategy is applied, rather than sending a request the server
+	// can't recover.
+	VerifyTransform bool
+	// StreamHeaders causes the connect request to be transformed and sent as soon as its
+	// request-line is complete, rather than buffering all of the headers first. It only takes effect
+	// if every rule in AlgenevaStrategy targets the request-line (method, path, or version).
+	StreamHeaders bool
+	// WriteJitterMin and WriteJitterMax, if WriteJitterMax is greater than zero, delay each write by a
+	// random duration between them so the timing of the tunnel's writes doesn't reveal the timing of
+	// the application's. Writes are still sent in order. This adds latency to every write, so it
+	// should only be enabled when timing analysis is a concern.
+	WriteJitterMin time.Duration
+	WriteJitterMax time.Duration
+	// MaxHeaderBytes is the maximum number of bytes of the connect request buffered while waiting
+	// for the end of its headers. If exceeded, the dial fails with ErrHeaderTooLarge. If zero,
+	// DefaultMaxHeaderBytes is used.
+	MaxHeaderBytes int
+	// MaxRequestBytes, if greater than zero, causes the dial to fail with ErrRequestTooLarge if the
+	// transformed connect request is larger than MaxRequestBytes, rather than sending a request the
+	// server's header limit would reject. Verbose strategies can inflate the request considerably.
+	MaxRequestBytes int
+	// HeaderTimeout, if greater than zero, is how long the connect request may be buffered waiting
+	// for the end of its headers. If it elapses first, the buffered data is sent as is, without
+	// applying the geneva strategy, rather than being held forever. If RequireTransform is set, the
+	// connection is closed instead, so nothing is sent un-obfuscated.
+	HeaderTimeout time.Duration
+	// TransformMethods lists the HTTP methods that mark the first write as a request to transform.
+	// If the first write doesn't start with one of them followed by a space, it's sent as is,
+	// without buffering or applying the geneva strategy. If empty, the methods defined in RFC 9110
+	// and PATCH are used.
+	TransformMethods []string
+	// WSTransport is the websocket implementation used to perform the handshake. If nil,
+	// nhooyr.io/websocket is used.
+	WSTransport WSTransport
+	// CompressionMode is the websocket permessage-deflate mode offered in the handshake. The zero
+	// value, websocket.CompressionDisabled, is recommended when tunneling TLS, since encrypted data
+	// doesn't compress and the extension is a fingerprint. Ignored if WSTransport is set.
+	CompressionMode websocket.CompressionMode
+	// WSPath, if not empty, is the path of the websocket upgrade request, e.g. "/socket.io/", so the
+	// request can mimic a real site's websocket endpoint instead of a predictable default. It must
+	// begin with "/". The listener accepts upgrades on any path.
+	WSPath string
+	// WSHost, if not empty, is sent as the Host of the websocket upgrade request in place of the
+	// dialed address. The connection is still made to the dialed address.
+	WSHost string
+	// MaxConnLifetime, if greater than zero, is the maximum amount of time a connection stays open.
+	// Once it elapses, the connection is closed so the caller re-dials, rotating the tunnel. Callers
+	// must be prepared to handle the close.
+	MaxConnLifetime time.Duration
+	// KeepAlive, if greater than zero, is how often a websocket ping is sent to keep idle tunnels
+	// from being dropped by stateful middleboxes. If the server doesn't respond within KeepAlive,
+	// the connection is closed. Pongs are only received while the connection is being read from, so
+	// callers must keep a read pending. Ignored if the WSTransport doesn't support pings.
+	KeepAlive time.Duration
+	// OnOutcome, if not nil, is called once per dial with AlgenevaStrategy and the outcome of the
+	// connection, so the effectiveness of strategies can be recorded, e.g. with
+	// StrategyInfo.RecordSuccess. err is nil if the connection succeeded. By default, a connection
+	// succeeds once the first read after the handshake returns data; a read error, or closing the
+	// connection before any data is read, is a failure. A failed dial is always a failure.
+	OnOutcome func(ctx context.Context, strategy string, err error)
+	// OutcomeOnHandshake causes OnOutcome to report success as soon as the handshake completes,
+	// rather than waiting for the first successful read.
+	OutcomeOnHandshake bool
+	// Rand is the source of randomness for randomized features, such as write jitter and the default
+	// StrategySelector. If nil, crypto/rand.Reader is used. Tests can set it to a deterministic
+	// source to make those features reproducible.
+	Rand io.Reader
+	// Histograms, if not nil, accumulates the latency of each phase of the dial.
+	Histograms *HandshakeHistograms
+	// Metrics, if not nil, is told when the connect request has been transformed.
+	Metrics Metrics
+	// Logger, if not nil, logs failed dials along with the address, the strategy, and whether the
+	// connect request failed to be transformed or the handshake failed. It also warns when the
+	// connect request is sent without applying the strategy, and when ReadBufferSize or
+	// WriteBufferSize can't be applied to the socket.
+	Logger *slog.Logger
+	// clock is used by time-based features. If nil, the real clock is used.
+	clock clock
 }
 
-// Dial performs a websocket handshake over TCP with the given address. If opts.AlgenevaStrategy is
-// not empty, it will apply the geneva strategy to the connect request.
-// Dial uses the background context; to specify a context, use DialContext.
+// Dial performs a websocket handshake with the given address over network, which must be "tcp",
+// "tcp4", or "tcp6". If opts.AlgenevaStrategy is not empty, it will apply the geneva strategy to
+// the connect request.
+// Dial is equivalent to calling DialContext with context.Background().
 func Dial(network, address string, opts DialerOpts) (net.Conn, error) {
-	return DialContext(context.Background(), "TCP", address, opts)
+	return DialContext(context.Background(), network, address, opts)
 }
 
-// DialContext performs a websocket handshake over TCP with the given address using the provided
-// context. If opts.AlgenevaStrategy is not empty, it will be applied to the handshake request.
+// DialContext performs a websocket handshake with the given address over network using the
+// provided context. network must be "tcp", "tcp4", or "tcp6"; use "tcp4" or "tcp6" to restrict the
+// connection to IPv4 or IPv6 addresses. If opts.AlgenevaStrategy is not empty, it will be applied
+// to the handshake request.
+//
+// Options such as TLSConfig, WriteJitterMax, MaxConnLifetime, and OnOutcome wrap the returned
+// connection, so it shouldn't be type asserted, e.g. to a *tls.Conn. Use ConnStrategy,
+// TransformedFirstRequest, and SyscallConn instead, which see through the wrappers.
 func DialContext(ctx context.Context, network, address string, opts DialerOpts) (net.Conn, error) {
+	opts = opts.selectStrategy()
+	if len(opts.FallbackStrategies) == 0 {
+		return dialReported(ctx, network, address, opts)
+	}
+
+	strategies := append([]string{opts.AlgenevaStrategy}, opts.FallbackStrategies...)
+	opts.FallbackStrategies = nil
+	var errs []error
+	for _, strategy := range strategies {
+		opts.AlgenevaStrategy = strategy
+		conn, err := dialReported(ctx, network, address, opts)
+		if err == nil {
+			return conn, nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", strategy, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrNoWorkingStrategy, errors.Join(errs...))
+}
+
+// dialReported dials with opts.AlgenevaStrategy, logging a failure to opts.Logger and reporting the
+// outcome to opts.OnOutcome.
+func dialReported(ctx context.Context, network, address string, opts DialerOpts) (net.Conn, error) {
+	conn, err := dial(ctx, network, address, opts)
+	if err != nil && opts.Logger != nil {
+		stage := "handshake"
+		if errors.Is(err, ErrFirstRequestNotWritten) {
+			stage = "transform"
+		}
+		opts.Logger.LogAttrs(ctx, slog.LevelWarn, "genevahttp: dial failed",
+			slog.String("address", address),
+			slog.String("strategy", opts.AlgenevaStrategy),
+			slog.String("stage", stage),
+			slog.Any("error", err),
+		)
+	}
+
+	if opts.OnOutcome == nil {
+		return conn, err
+	}
+
+	report := func(err error) { opts.OnOutcome(ctx, opts.AlgenevaStrategy, err) }
+	if err != nil || opts.OutcomeOnHandshake {
+		report(err)
+		return conn, err
+	}
+
+	return &outcomeConn{Conn: conn, report: report}, nil
+}
+
+// dial performs the websocket handshake and wraps the resulting connection according to opts.
+func dial(ctx context.Context, network, address string, opts DialerOpts) (net.Conn, error) {
+	network, err := validateNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateAddress(address); err != nil {
+		return nil, err
+	}
+
+	url, err := wsURL(address, opts)
+	if err != nil {
+		return nil, err
+	}
+
 	if opts.AlgenevaStrategy != "" {
-		strategy, err := algeneva.NewHTTPStrategy(opts.AlgenevaStrategy)
+		strategy, err := compileStrategy(opts.AlgenevaStrategy)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create geneva strategy: %w", err)
 		}
 		opts.strategy = strategy
 	}
+	if opts.strategy == nil && opts.RequireTransform {
+		return nil, fmt.Errorf("%w: no strategy configured", ErrTransformNoOp)
+	}
 
-	wsopts := &websocket.DialOptions{
-		HTTPClient: &http.Client{
-			Transport: &http.Transport{DialContext: dialContext(opts)},
-		},
+	transport := opts.WSTransport
+	if transport == nil {
+		transport = nhooyrTransport{compressionMode: opts.CompressionMode}
 	}
-	wsc, _, err := websocket.Dial(ctx, "ws://"+address, wsopts)
+
+	var (
+		clk         = opts.getClock()
+		base        net.Conn
+		connectTime time.Duration
+	)
+	// The websocket client always dials "tcp" and the host of the URL, which may be opts.WSHost, so
+	// the caller's network and address are used instead.
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		c, err := dialContext(opts)(ctx, network, address)
+		base = c
+		return c, err
+	}
+	if opts.Histograms != nil {
+		inner := dial
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			start := clk.Now()
+			c, err := inner(ctx, network, address)
+			connectTime = clk.Since(start)
+			if err == nil {
+				opts.Histograms.Connect.Observe(connectTime)
+			}
+			return c, err
+		}
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: dial},
+	}
+	start := clk.Now()
+	conn, err := transport.Dial(ctx, url, client)
 	if err != nil {
 		return nil, err
 	}
 
-	conn := websocket.NetConn(context.Background(), wsc, websocket.MessageBinary)
+	if nc, ok := conn.(*nhooyrConn); ok {
+		nc.base = base
+	}
+
+	if ka, ok := conn.(keepAliver); ok && opts.KeepAlive > 0 {
+		ka.KeepAlive(opts.KeepAlive, opts.getClock())
+	}
+
+	if opts.Histograms != nil {
+		opts.Histograms.Websocket.Observe(clk.Since(start) - connectTime)
+	}
+
+	if opts.WriteChunkSize > 0 {
+		conn = &chunkedConn{Conn: conn, chunkSize: opts.WriteChunkSize}
+	}
+
 	if opts.TLSConfig == nil {
-		return conn, nil
+		return withLifetime(withJitter(conn, opts), opts), nil
 	}
 
-	tlsConn := tls.Client(conn, opts.TLSConfig)
+	start = clk.Now()
+	tlsConn := tls.Client(conn, clientTLSConfig(opts))
 	if err := tlsConn.Handshake(); err != nil {
 		tlsConn.Close()
 		return nil, err
 	}
 
-	return tlsConn, nil
+	if opts.Histograms != nil {
+		opts.Histograms.TLS.Observe(clk.Since(start))
+	}
+
+	return withLifetime(withJitter(tlsConn, opts), opts), nil
+}
+
+// withJitter wraps c in a jitterConn if opts.WriteJitterMax is set. Otherwise, c is returned as is.
+func withJitter(c net.Conn, opts DialerOpts) net.Conn {
+	if opts.WriteJitterMax <= 0 {
+		return c
+	}
+
+	return newJitterConn(c, opts.WriteJitterMin, opts.WriteJitterMax, opts.getClock(), opts.getRand())
+}
+
+// DialContextBound is like DialContext, but the returned connection stays bound to ctx after the
+// dial: it is closed automatically once ctx is done. With DialContext, ctx only covers the dial
+// and the connection outlives it. This is useful for connections scoped to a request.
+func DialContextBound(ctx context.Context, network, address string, opts DialerOpts) (net.Conn, error) {
+	conn, err := DialContext(ctx, network, address, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBoundConn(ctx, conn), nil
+}
+
+// withLifetime wraps c in a lifetimeConn if opts.MaxConnLifetime is set. Otherwise, c is returned
+// as is.
+func withLifetime(c net.Conn, opts DialerOpts) net.Conn {
+	if opts.MaxConnLifetime <= 0 {
+		return c
+	}
+
+	return newLifetimeConn(c, opts.MaxConnLifetime, opts.getClock())
 }
 
 // dialContext returns a dial function that connects to the given address and wraps the resulting
@@ -76,16 +372,144 @@ func DialContext(ctx context.Context, network, address string, opts DialerOpts)
 // establish the connection. Otherwise, the default dialer is used.
 func dialContext(opts DialerOpts) func(ctx context.Context, network, address string) (net.Conn, error) {
 	return func(ctx context.Context, network, address string) (net.Conn, error) {
-		dialer := opts.Dialer
-		if dialer == nil {
-			dialer = &net.Dialer{}
-		}
-
-		cc, err := dialer.DialContext(ctx, network, address)
+		cc, err := baseDialer(opts).DialContext(ctx, network, address)
 		if err != nil {
 			return nil, err
 		}
 
-		return &httpTransformConn{Conn: cc, httpTransform: opts.strategy}, nil
+		return newHTTPTransformConn(ctx, cc, opts), nil
 	}
 }
+
+// baseDialer returns the Dialer used to establish the underlying connection. If opts.Dialer is nil,
+// a net.Dialer is returned that applies opts.ReadBufferSize and opts.WriteBufferSize to the socket.
+func baseDialer(opts DialerOpts) Dialer {
+	if opts.Dialer != nil {
+		return opts.Dialer
+	}
+
+	dialer := &net.Dialer{}
+	if opts.ReadBufferSize > 0 || opts.WriteBufferSize > 0 {
+		dialer.Control = bufferSizeControl(opts.ReadBufferSize, opts.WriteBufferSize, setSockBuf, opts.Logger)
+	}
+
+	return dialer
+}
+
+// newHTTPTransformConn wraps cc in a httpTransformConn configured from opts. ctx is the context
+// cc was dialed with.
+func newHTTPTransformConn(ctx context.Context, cc net.Conn, opts DialerOpts) *httpTransformConn {
+	return &httpTransformConn{
+		Conn:             cc,
+		httpTransform:    opts.strategy,
+		strategy:         opts.AlgenevaStrategy,
+		ctx:              ctx,
+		onTransform:      opts.OnTransform,
+		requireTransform: opts.RequireTransform,
+		verifyTransform:  opts.VerifyTransform,
+		streamHeaders:    opts.StreamHeaders && requestLineOnly(opts.AlgenevaStrategy),
+		maxHeaderBytes:   opts.MaxHeaderBytes,
+		maxRequestBytes:  opts.MaxRequestBytes,
+		headerTimeout:    opts.HeaderTimeout,
+		methods:          opts.TransformMethods,
+		metrics:          opts.Metrics,
+		logger:           opts.Logger,
+		clock:            opts.getClock(),
+	}
+}
+
+// clientTLSConfig returns the tls.Config to use for the inner TLS connection. If
+// opts.TLSConfig.ClientSessionCache is nil, a copy of opts.TLSConfig is returned using
+// opts.SessionCache, or defaultSessionCache if that is nil too.
+func clientTLSConfig(opts DialerOpts) *tls.Config {
+	tlsConfig := opts.TLSConfig
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ClientSessionCache = opts.SessionCache
+		if tlsConfig.ClientSessionCache == nil {
+			tlsConfig.ClientSessionCache = defaultSessionCache
+		}
+	}
+
+	return tlsConfig
+}
+
+// selectStrategy returns opts with AlgenevaStrategy set to the strategy picked from
+// opts.AlgenevaStrategies by opts.StrategySelector. If opts.AlgenevaStrategies is empty, opts is
+// returned as is.
+func (opts DialerOpts) selectStrategy() DialerOpts {
+	if len(opts.AlgenevaStrategies) == 0 {
+		return opts
+	}
+
+	selector := opts.StrategySelector
+	if selector == nil {
+		selector = RandomSelector{Rand: opts.getRand()}
+	}
+
+	opts.AlgenevaStrategy = opts.AlgenevaStrategies[selector.Select(len(opts.AlgenevaStrategies))]
+	opts.AlgenevaStrategies = nil
+	return opts
+}
+
+// getClock returns opts.clock, or the real clock if it is nil.
+func (opts DialerOpts) getClock() clock {
+	if opts.clock == nil {
+		return realClock{}
+	}
+
+	return opts.clock
+}
+
+// getRand returns opts.Rand, or crypto/rand.Reader if it is nil.
+func (opts DialerOpts) getRand() io.Reader {
+	if opts.Rand == nil {
+		return rand.Reader
+	}
+
+	return opts.Rand
+}
+
+// wsURL returns the URL of the websocket upgrade request for address, using opts.WSHost and
+// opts.WSPath if set. An error wrapping ErrInvalidWSPath is returned if opts.WSPath doesn't begin
+// with "/".
+func wsURL(address string, opts DialerOpts) (string, error) {
+	if opts.WSPath != "" && !strings.HasPrefix(opts.WSPath, "/") {
+		return "", fmt.Errorf("%w: %q must begin with \"/\"", ErrInvalidWSPath, opts.WSPath)
+	}
+
+	host := address
+	if opts.WSHost != "" {
+		host = opts.WSHost
+	}
+
+	return "ws://" + host + opts.WSPath, nil
+}
+
+// validateNetwork returns network in lower case, or an error wrapping ErrUnsupportedNetwork if it
+// isn't a TCP network.
+func validateNetwork(network string) (string, error) {
+	network = strings.ToLower(network)
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return network, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedNetwork, network)
+	}
+}
+
+// validateAddress returns ErrInvalidAddress if address is not in the form "host:port". IPv6 hosts
+// must be enclosed in square brackets, e.g. "[::1]:80".
+func validateAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	switch {
+	case err != nil:
+		return fmt.Errorf("%w: %w", ErrInvalidAddress, err)
+	case host == "":
+		return fmt.Errorf("%w: missing host in address %q", ErrInvalidAddress, address)
+	case port == "":
+		return fmt.Errorf("%w: missing port in address %q", ErrInvalidAddress, address)
+	}
+
+	return nil
+}
@@ -0,0 +1,515 @@
+package genevahttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		wantErr bool
+	}{
+		{name: "valid", address: "example.com:443"},
+		{name: "valid IPv4", address: "127.0.0.1:80"},
+		{name: "valid IPv6", address: "[::1]:80"},
+		{name: "missing port", address: "example.com", wantErr: true},
+		{name: "empty port", address: "example.com:", wantErr: true},
+		{name: "missing host", address: ":443", wantErr: true},
+		{name: "unbracketed IPv6", address: "::1:80", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAddress(tt.address)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidAddress)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDialContextInvalidAddress(t *testing.T) {
+	dialer := &mockDialer{}
+	_, err := DialContext(context.Background(), "tcp", "example.com", DialerOpts{Dialer: dialer})
+	assert.ErrorIs(t, err, ErrInvalidAddress)
+	assert.False(t, dialer.used, "dialer should not be used for an invalid address")
+}
+
+func TestDialContextUnsupportedNetwork(t *testing.T) {
+	dialer := &mockDialer{}
+	for _, network := range []string{"udp", "unix", ""} {
+		_, err := DialContext(context.Background(), network, "example.com:80", DialerOpts{Dialer: dialer})
+		assert.ErrorIs(t, err, ErrUnsupportedNetwork, network)
+	}
+	assert.False(t, dialer.used, "dialer should not be used for an unsupported network")
+}
+
+// networkDialer is a Dialer that records the networks it was asked to dial and the remote
+// addresses of the resulting connections.
+type networkDialer struct {
+	mx       sync.Mutex
+	networks []string
+	remotes  []net.Addr
+}
+
+func (d *networkDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *networkDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.networks = append(d.networks, network)
+	if err == nil {
+		d.remotes = append(d.remotes, c.RemoteAddr())
+	}
+	return c, err
+}
+
+func TestDialContextNetwork(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+
+	dialer := &networkDialer{}
+	c, err := DialContext(context.Background(), "TCP4", net.JoinHostPort("localhost", port), DialerOpts{Dialer: dialer})
+	require.NoError(t, err)
+	sc, err := ll.Accept()
+	require.NoError(t, err)
+	go sc.Close()
+	c.Close()
+
+	assert.Equal(t, []string{"tcp4"}, dialer.networks)
+	for _, addr := range dialer.remotes {
+		assert.NotNil(t, addr.(*net.TCPAddr).IP.To4(), "%v is not an IPv4 address", addr)
+	}
+}
+
+func TestDialContextOnTransform(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	go acceptAndClose(ll)
+
+	type ctxKey struct{}
+	dial := func(id string) string {
+		var got string
+		opts := DialerOpts{
+			AlgenevaStrategy: testStrategy(t, "China", 17),
+			OnTransform: func(ctx context.Context, req, transformed []byte) {
+				got, _ = ctx.Value(ctxKey{}).(string)
+			},
+		}
+
+		ctx := context.WithValue(context.Background(), ctxKey{}, id)
+		c, err := DialContext(ctx, "tcp", l.Addr().String(), opts)
+		require.NoError(t, err)
+		c.Close()
+		return got
+	}
+
+	assert.Equal(t, "conn-1", dial("conn-1"))
+	assert.Equal(t, "conn-2", dial("conn-2"))
+}
+
+// acceptAndClose accepts connections from l and immediately closes them until l is closed.
+func acceptAndClose(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Close()
+	}
+}
+
+func TestDialContextSessionResumption(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer ll.Close()
+
+	go func() {
+		for {
+			c, err := ll.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	rootCertPool := x509.NewCertPool()
+	require.True(t, rootCertPool.AppendCertsFromPEM([]byte(certPEM)))
+
+	opts := DialerOpts{
+		TLSConfig:    &tls.Config{RootCAs: rootCertPool, ServerName: "localhost"},
+		SessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	dial := func() tls.ConnectionState {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		c, err := DialContext(ctx, "tcp", l.Addr().String(), opts)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// Round-trip some data so the client receives the server's session ticket.
+		_, err = c.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(c, buf)
+		require.NoError(t, err)
+
+		return c.(*tls.Conn).ConnectionState()
+	}
+
+	assert.False(t, dial().DidResume, "first connection should do a full handshake")
+	assert.True(t, dial().DidResume, "second connection should resume the TLS session")
+	assert.Nil(t, opts.TLSConfig.ClientSessionCache, "caller's TLSConfig should not be modified")
+}
+
+func TestDialContextRequireTransform(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	go acceptAndClose(ll)
+
+	// The trigger never matches the GET connect request, so the strategy doesn't modify it.
+	opts := DialerOpts{
+		AlgenevaStrategy: "[HTTP:method:PATCH]-insert{%20:end:value:1}-|",
+		RequireTransform: true,
+	}
+	_, err = DialContext(context.Background(), "tcp", l.Addr().String(), opts)
+	assert.ErrorIs(t, err, ErrTransformNoOp)
+
+	opts.RequireTransform = false
+	c, err := DialContext(context.Background(), "tcp", l.Addr().String(), opts)
+	require.NoError(t, err)
+	c.Close()
+
+	// Without a strategy there's nothing to transform the request, so it would always be sent
+	// un-obfuscated.
+	_, err = DialContext(context.Background(), "tcp", l.Addr().String(), DialerOpts{RequireTransform: true})
+	assert.ErrorIs(t, err, ErrTransformNoOp)
+}
+
+type stubTransport struct {
+	dialedURL string
+	conn      net.Conn
+}
+
+func (s *stubTransport) Dial(ctx context.Context, url string, client *http.Client) (net.Conn, error) {
+	s.dialedURL = url
+	return s.conn, nil
+}
+
+func (s *stubTransport) Accept(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestDialContextWSTransport(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	transport := &stubTransport{conn: client}
+	c, err := DialContext(context.Background(), "tcp", "example.com:80", DialerOpts{WSTransport: transport})
+	require.NoError(t, err)
+	defer c.Close()
+
+	assert.Equal(t, "ws://example.com:80", transport.dialedURL)
+
+	go c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(server, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestDialContextWSPathAndHost(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	requests := make(chan []byte, 1)
+	wl, _ := WrapListenerWithOpts(l, WrapListenerOpts{
+		AllowedHosts: []string{"cdn.example.com"},
+		OnNormalize:  func(_, normalized []byte) { requests <- normalized },
+	})
+	defer wl.Close()
+
+	opts := DialerOpts{WSPath: "/socket.io/", WSHost: "cdn.example.com"}
+	c, err := DialContext(context.Background(), "tcp", l.Addr().String(), opts)
+	require.NoError(t, err)
+	sc, err := wl.Accept()
+	require.NoError(t, err)
+	go sc.Close()
+	c.Close()
+
+	req := string(<-requests)
+	assert.True(t, strings.HasPrefix(req, "GET /socket.io/ HTTP/1.1\r\n"), req)
+	assert.Contains(t, req, "\r\nHost: cdn.example.com\r\n")
+}
+
+func TestDialContextInvalidWSPath(t *testing.T) {
+	dialer := &mockDialer{}
+	_, err := DialContext(context.Background(), "tcp", "example.com:80", DialerOpts{Dialer: dialer, WSPath: "socket.io"})
+	assert.ErrorIs(t, err, ErrInvalidWSPath)
+	assert.False(t, dialer.used, "dialer should not be used for an invalid path")
+}
+
+func TestDialContextLogger(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	var logs syncBuffer
+	opts := DialerOpts{
+		AlgenevaStrategy: testStrategy(t, "China", 17),
+		MaxRequestBytes:  1,
+		Logger:           slog.New(slog.NewTextHandler(&logs, nil)),
+	}
+	_, err = DialContext(context.Background(), "tcp", l.Addr().String(), opts)
+	require.ErrorIs(t, err, ErrRequestTooLarge)
+	assert.Contains(t, logs.String(), "stage=transform")
+	assert.Contains(t, logs.String(), "address="+l.Addr().String())
+}
+
+func TestDialMatchesDialContext(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	go acceptAndClose(ll)
+
+	dialers := map[string]func(address string, opts DialerOpts) (net.Conn, error){
+		"Dial": func(address string, opts DialerOpts) (net.Conn, error) {
+			return Dial("tcp", address, opts)
+		},
+		"DialContext": func(address string, opts DialerOpts) (net.Conn, error) {
+			return DialContext(context.Background(), "tcp", address, opts)
+		},
+	}
+	for name, dial := range dialers {
+		t.Run(name, func(t *testing.T) {
+			dialer := &mockDialer{}
+			opts := DialerOpts{AlgenevaStrategy: testStrategy(t, "China", 17), Dialer: dialer}
+
+			c, err := dial(l.Addr().String(), opts)
+			require.NoError(t, err)
+			c.Close()
+			assert.True(t, dialer.used)
+
+			_, err = dial("example.com", opts)
+			assert.ErrorIs(t, err, ErrInvalidAddress)
+
+			opts.AlgenevaStrategy = "not a strategy"
+			_, err = dial(l.Addr().String(), opts)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestDialContextMaxConnLifetime(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	go func() {
+		for {
+			c, err := ll.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	clk := newFakeClock()
+	opts := DialerOpts{MaxConnLifetime: time.Hour, clock: clk}
+	c, err := DialContext(context.Background(), "tcp", l.Addr().String(), opts)
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, 4))
+	require.NoError(t, err)
+
+	clk.waitForTimers(1)
+	clk.Advance(time.Hour)
+
+	readErr := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	select {
+	case err := <-readErr:
+		assert.Error(t, err, "connection should be closed after its lifetime")
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed after its lifetime")
+	}
+}
+
+func TestDialContextBound(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	go func() {
+		for {
+			c, err := ll.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, err := DialContextBound(ctx, "tcp", l.Addr().String(), DialerOpts{})
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, 4))
+	require.NoError(t, err)
+
+	readErr := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	cancel()
+
+	select {
+	case err := <-readErr:
+		assert.Error(t, err, "connection should be closed when the context is cancelled")
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed when the context was cancelled")
+	}
+}
+
+func TestDialContextOnOutcome(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	go func() {
+		for {
+			c, err := ll.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	type outcome struct {
+		strategy string
+		err      error
+	}
+	outcomes := make(chan outcome, 1)
+	opts := DialerOpts{
+		AlgenevaStrategy: testStrategy(t, "China", 17),
+		OnOutcome: func(ctx context.Context, strategy string, err error) {
+			outcomes <- outcome{strategy, err}
+		},
+	}
+
+	t.Run("success", func(t *testing.T) {
+		c, err := DialContext(context.Background(), "tcp", l.Addr().String(), opts)
+		require.NoError(t, err)
+		defer c.Close()
+
+		assert.Empty(t, outcomes, "outcome should not be reported before the first read")
+		_, err = c.Write([]byte("ping"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(c, make([]byte, 4))
+		require.NoError(t, err)
+
+		o := <-outcomes
+		assert.Equal(t, opts.AlgenevaStrategy, o.strategy)
+		assert.NoError(t, o.err)
+	})
+
+	t.Run("closed before read", func(t *testing.T) {
+		c, err := DialContext(context.Background(), "tcp", l.Addr().String(), opts)
+		require.NoError(t, err)
+		c.Close()
+
+		assert.ErrorIs(t, (<-outcomes).err, ErrNoData)
+	})
+
+	t.Run("dial failure", func(t *testing.T) {
+		dl, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		go acceptAndClose(dl)
+		defer dl.Close()
+
+		_, err = DialContext(context.Background(), "tcp", dl.Addr().String(), opts)
+		require.Error(t, err)
+
+		assert.Error(t, (<-outcomes).err)
+	})
+
+	t.Run("on handshake", func(t *testing.T) {
+		opts := opts
+		opts.OutcomeOnHandshake = true
+		c, err := DialContext(context.Background(), "tcp", l.Addr().String(), opts)
+		require.NoError(t, err)
+		defer c.Close()
+
+		assert.NoError(t, (<-outcomes).err)
+	})
+}
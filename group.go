@@ -0,0 +1,175 @@
+package genevahttp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerGroup wraps multiple net.Listeners with the same WrapListenerOpts and hands out the
+// connections accepted by all of them from a single Accept, e.g. for a server listening on several
+// ports. ListenerGroup implements net.Listener.
+type ListenerGroup struct {
+	opts WrapListenerOpts
+
+	mx        sync.Mutex
+	listeners []Listener
+
+	// connections receives the connections accepted by all of the listeners.
+	connections chan net.Conn
+	// errC receives the errors from all of the listeners.
+	errC chan error
+	// droppedErrs is the number of errors dropped because errC was full.
+	droppedErrs atomic.Uint64
+	// closed is closed when the group is closed.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListenerGroup returns an empty ListenerGroup that wraps listeners with opts. If
+// opts.AcceptTimeout is set, it applies to the group's Accept rather than each listener.
+func NewListenerGroup(opts WrapListenerOpts) *ListenerGroup {
+	return &ListenerGroup{
+		opts:        opts,
+		connections: make(chan net.Conn),
+		errC:        make(chan error, 20),
+		closed:      make(chan struct{}),
+	}
+}
+
+// Add wraps l and adds it to the group. Closing the group closes l.
+func (g *ListenerGroup) Add(l net.Listener) error {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	select {
+	case <-g.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	opts := g.opts
+	opts.AcceptTimeout = 0
+	wl, errC := WrapListenerWithOpts(l, opts)
+	g.listeners = append(g.listeners, wl)
+
+	go g.forwardConns(wl)
+	go g.forwardErrors(errC)
+	return nil
+}
+
+// forwardConns hands out the connections accepted by l until l or the group is closed.
+func (g *ListenerGroup) forwardConns(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		select {
+		case g.connections <- c:
+		case <-g.closed:
+			c.Close()
+			return
+		}
+	}
+}
+
+// forwardErrors sends the errors from errC to g.errC until the group is closed. Errors are dropped
+// if g.errC is full.
+func (g *ListenerGroup) forwardErrors(errC <-chan error) {
+	for {
+		select {
+		case err := <-errC:
+			select {
+			case g.errC <- err:
+			default:
+				g.droppedErrs.Add(1)
+			}
+		case <-g.closed:
+			return
+		}
+	}
+}
+
+// Accept implements net.Listener and returns the next connection accepted by any of the listeners.
+func (g *ListenerGroup) Accept() (net.Conn, error) {
+	var timeout <-chan time.Time
+	if g.opts.AcceptTimeout > 0 {
+		t := g.opts.getClock().NewTimer(g.opts.AcceptTimeout)
+		defer t.Stop()
+		timeout = t.C()
+	}
+
+	select {
+	case c := <-g.connections:
+		return c, nil
+	case <-g.closed:
+		return nil, net.ErrClosed
+	case <-timeout:
+		return nil, ErrAcceptTimeout
+	}
+}
+
+// Close implements net.Listener and closes all of the listeners in the group. As with the listener
+// returned by WrapListener, connections already handed out by Accept are not closed.
+func (g *ListenerGroup) Close() error {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	var errs []error
+	g.closeOnce.Do(func() {
+		close(g.closed)
+		for _, l := range g.listeners {
+			errs = append(errs, l.Close())
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// Addr implements net.Listener and returns the address of the first listener added to the group,
+// or nil if there are none. Use Addrs for all of them.
+func (g *ListenerGroup) Addr() net.Addr {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	if len(g.listeners) == 0 {
+		return nil
+	}
+
+	return g.listeners[0].Addr()
+}
+
+// Addrs returns the addresses of all of the listeners in the group.
+func (g *ListenerGroup) Addrs() []net.Addr {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	addrs := make([]net.Addr, len(g.listeners))
+	for i, l := range g.listeners {
+		addrs[i] = l.Addr()
+	}
+
+	return addrs
+}
+
+// Errors returns a channel that receives the errors encountered by all of the listeners when a
+// client tries to connect. Errors are dropped if the channel is full; the number of dropped errors
+// can be read with DroppedErrors.
+func (g *ListenerGroup) Errors() <-chan error {
+	return g.errC
+}
+
+// DroppedErrors returns the number of errors dropped by the group and its listeners.
+func (g *ListenerGroup) DroppedErrors() uint64 {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	dropped := g.droppedErrs.Load()
+	for _, l := range g.listeners {
+		dropped += l.DroppedErrors()
+	}
+
+	return dropped
+}
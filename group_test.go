@@ -0,0 +1,68 @@
+package genevahttp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerGroup(t *testing.T) {
+	g := NewListenerGroup(WrapListenerOpts{})
+	defer g.Close()
+
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		require.NoError(t, g.Add(l))
+	}
+
+	addrs := g.Addrs()
+	require.Len(t, addrs, 2)
+	assert.Equal(t, addrs[0], g.Addr())
+
+	// Dial each listener and accept both connections from the group's single accept loop.
+	for _, addr := range addrs {
+		c, err := Dial("tcp", addr.String(), DialerOpts{})
+		require.NoError(t, err)
+
+		sc, err := g.Accept()
+		require.NoError(t, err)
+
+		_, err = c.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = sc.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buf))
+
+		go sc.Close()
+		c.Close()
+	}
+
+	require.NoError(t, g.Close())
+	_, err := g.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	assert.ErrorIs(t, g.Add(l), net.ErrClosed, "listeners can't be added to a closed group")
+}
+
+func TestListenerGroupAcceptTimeout(t *testing.T) {
+	clk := newFakeClock()
+	g := NewListenerGroup(WrapListenerOpts{AcceptTimeout: time.Minute, clock: clk})
+	defer g.Close()
+
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := g.Accept()
+		acceptErr <- err
+	}()
+	clk.waitForTimers(1)
+	clk.Advance(time.Minute)
+	assert.ErrorIs(t, <-acceptErr, ErrAcceptTimeout)
+}
@@ -0,0 +1,80 @@
+package genevahttp
+
+import (
+	"sync"
+	"time"
+)
+
+// numHistogramBuckets is the number of buckets in a Histogram, not counting the overflow bucket.
+const numHistogramBuckets = 17
+
+// histogramBuckets are the upper bounds of the buckets used by Histogram. They double from 1ms to
+// ~65s, which keeps the histogram small while covering the range of handshake latencies. Durations
+// greater than the last bound are counted in an overflow bucket.
+var histogramBuckets = func() []time.Duration {
+	bounds := make([]time.Duration, numHistogramBuckets)
+	for i := range bounds {
+		bounds[i] = time.Millisecond << i
+	}
+	return bounds
+}()
+
+// Histogram is a lightweight, concurrency-safe latency histogram with exponential buckets.
+type Histogram struct {
+	mx sync.Mutex
+	// counts holds the number of observations in each bucket. The last element is the overflow
+	// bucket.
+	counts [numHistogramBuckets + 1]uint64
+	count  uint64
+	sum    time.Duration
+}
+
+// HistogramSnapshot is a point-in-time copy of a Histogram.
+type HistogramSnapshot struct {
+	// Bounds are the inclusive upper bounds of each bucket.
+	Bounds []time.Duration
+	// Counts are the number of observations in each bucket. Counts has one more element than Bounds;
+	// the last element counts observations greater than the last bound.
+	Counts []uint64
+	// Count is the total number of observations.
+	Count uint64
+	// Sum is the sum of all observations.
+	Sum time.Duration
+}
+
+// Observe records d in the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBuckets) && d > histogramBuckets[i] {
+		i++
+	}
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+// Snapshot returns a copy of the histogram's current state.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	return HistogramSnapshot{
+		Bounds: append([]time.Duration{}, histogramBuckets...),
+		Counts: append([]uint64{}, h.counts[:]...),
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+}
+
+// HandshakeHistograms accumulates the latency of each phase of DialContext.
+type HandshakeHistograms struct {
+	// Connect is the time to establish the underlying connection, including DNS resolution.
+	Connect Histogram
+	// Websocket is the time to complete the websocket upgrade once connected.
+	Websocket Histogram
+	// TLS is the time to complete the TLS handshake. It is only observed if DialerOpts.TLSConfig is
+	// not nil.
+	TLS Histogram
+}
@@ -0,0 +1,75 @@
+package genevahttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	var h Histogram
+	h.Observe(500 * time.Microsecond)
+	h.Observe(3 * time.Millisecond)
+	h.Observe(time.Hour)
+
+	s := h.Snapshot()
+	assert.Equal(t, uint64(3), s.Count)
+	assert.Equal(t, time.Hour+3500*time.Microsecond, s.Sum)
+	require.Len(t, s.Counts, len(s.Bounds)+1)
+	assert.Equal(t, uint64(1), s.Counts[0], "<= 1ms")
+	assert.Equal(t, uint64(1), s.Counts[2], "<= 4ms")
+	assert.Equal(t, uint64(1), s.Counts[len(s.Counts)-1], "overflow")
+}
+
+func TestDialContextHistograms(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer ll.Close()
+
+	go func() {
+		for {
+			c, err := ll.Accept()
+			if err != nil {
+				return
+			}
+
+			// Read to drive the server side of the TLS handshake.
+			go func() {
+				defer c.Close()
+				c.Read(make([]byte, 1))
+			}()
+		}
+	}()
+
+	rootCertPool := x509.NewCertPool()
+	require.True(t, rootCertPool.AppendCertsFromPEM([]byte(certPEM)))
+
+	histograms := &HandshakeHistograms{}
+	opts := DialerOpts{
+		AlgenevaStrategy: testStrategy(t, "China", 17),
+		TLSConfig:        &tls.Config{RootCAs: rootCertPool, ServerName: "localhost"},
+		Histograms:       histograms,
+	}
+
+	const dials = 3
+	for i := 0; i < dials; i++ {
+		c, err := DialContext(context.Background(), "tcp", l.Addr().String(), opts)
+		require.NoError(t, err)
+		c.Close()
+	}
+
+	assert.Equal(t, uint64(dials), histograms.Connect.Snapshot().Count)
+	assert.Equal(t, uint64(dials), histograms.Websocket.Snapshot().Count)
+	assert.Equal(t, uint64(dials), histograms.TLS.Snapshot().Count)
+}
@@ -0,0 +1,80 @@
+package genevahttp
+
+import (
+	"net"
+	"net/http"
+)
+
+// ServeHTTPProxy runs a local HTTP proxy on listenAddr so applications configured with an HTTP
+// proxy can use the tunnel without code changes. Each CONNECT request is tunneled to the geneva
+// server at serverAddr, dialed with DialContext using opts, which then connects to the requested
+// host:port; the server must be running ServeTunnel. The proxy answers 200 Connection Established
+// and then copies data in both directions, or 502 Bad Gateway if the tunnel can't be established.
+// Other methods are answered with 405 Method Not Allowed. ServeHTTPProxy blocks until the server
+// fails.
+func ServeHTTPProxy(listenAddr, serverAddr string, opts DialerOpts) error {
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	return serveHTTPProxy(l, serverAddr, opts)
+}
+
+// serveHTTPProxy serves HTTP proxy connections accepted from l. See ServeHTTPProxy.
+func serveHTTPProxy(l net.Listener, serverAddr string, opts DialerOpts) error {
+	srv := &http.Server{Handler: httpProxyHandler{serverAddr: serverAddr, opts: opts}}
+	return srv.Serve(l)
+}
+
+// httpProxyHandler handles CONNECT requests by tunneling to the requested address through the
+// geneva server at serverAddr.
+type httpProxyHandler struct {
+	serverAddr string
+	opts       DialerOpts
+}
+
+func (h httpProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.Header().Set("Allow", http.MethodConnect)
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	up, err := dialTunnel(r.Context(), h.serverAddr, r.Host, h.opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	down, rw, err := hj.Hijack()
+	if err != nil {
+		up.Close()
+		return
+	}
+
+	if _, err := down.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		down.Close()
+		up.Close()
+		return
+	}
+
+	// The client may have sent data right after the request, which the server has already read.
+	if n := rw.Reader.Buffered(); n > 0 {
+		b, _ := rw.Reader.Peek(n)
+		if _, err := up.Write(b); err != nil {
+			down.Close()
+			up.Close()
+			return
+		}
+	}
+
+	splice(down, up)
+}
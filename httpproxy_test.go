@@ -0,0 +1,96 @@
+package genevahttp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startHTTPProxy starts an HTTP proxy that tunnels through the geneva server at serverAddr with
+// opts and returns its address.
+func startHTTPProxy(t *testing.T, serverAddr string, opts DialerOpts) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go serveHTTPProxy(l, serverAddr, opts)
+	return l.Addr().String()
+}
+
+func TestServeHTTPProxy(t *testing.T) {
+	// The target is an ordinary TCP server, reached through the tunnel.
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	// The target echoes until the client half-closes, then sends a final response.
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+		io.WriteString(c, "bye")
+	}()
+
+	opts := DialerOpts{AlgenevaStrategy: testStrategy(t, "China", 17)}
+	c, err := net.Dial("tcp", startHTTPProxy(t, startTunnelServer(t), opts))
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Data sent along with the request should be forwarded too.
+	target := l.Addr().String()
+	_, err = c.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\nping"))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	b := make([]byte, 4)
+	_, err = io.ReadFull(br, b)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+
+	// Half-closing the client is carried through the tunnel to the target, whose final response
+	// still reaches the client before EOF.
+	require.NoError(t, c.(*net.TCPConn).CloseWrite())
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(rest), "response sent after the half-close should be delivered")
+}
+
+func TestServeHTTPProxyErrors(t *testing.T) {
+	addr := startHTTPProxy(t, startTunnelServer(t), DialerOpts{})
+	proxyURL := func(*http.Request) (*url.URL, error) { return url.Parse("http://" + addr) }
+
+	t.Run("target unreachable", func(t *testing.T) {
+		target := closedAddr(t)
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, err = c.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n"))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+	t.Run("not CONNECT", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{Proxy: proxyURL}}
+		resp, err := client.Get("http://example.com/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
@@ -11,7 +11,6 @@ import (
 	"testing"
 	"time"
 
-	"github.com/getlantern/algeneva"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"nhooyr.io/websocket"
@@ -118,7 +117,7 @@ func TestWebsocket(t *testing.T) {
 	}
 	dialer := &mockDialer{}
 	opts := DialerOpts{
-		AlgenevaStrategy: algeneva.Strategies["China"][17],
+		AlgenevaStrategy: testStrategy(t, "China", 17),
 		Dialer:           dialer,
 		TLSConfig:        tlsConfig,
 	}
@@ -3,14 +3,41 @@ package genevahttp
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nhooyr.io/websocket"
 )
 
+// ErrHostNotAllowed is sent on the error channel returned by WrapListenerWithOpts when a request's
+// Host is not in WrapListenerOpts.AllowedHosts.
+var ErrHostNotAllowed = errors.New("host not allowed")
+
+// ErrListenerClosed is returned by the listener's Accept once the listener has been closed or shut
+// down.
+var ErrListenerClosed = errors.New("listener closed")
+
+// ErrAcceptTimeout is returned by the listener's Accept if no connection arrives within
+// WrapListenerOpts.AcceptTimeout. It implements net.Error and reports itself as a timeout, so
+// accept loops can treat it as transient.
+var ErrAcceptTimeout net.Error = acceptTimeoutError{}
+
+type acceptTimeoutError struct{}
+
+func (acceptTimeoutError) Error() string   { return "accept timed out" }
+func (acceptTimeoutError) Timeout() bool   { return true }
+func (acceptTimeoutError) Temporary() bool { return true }
+
+// baseConnKey is the context key for the connection a request was received on.
+type baseConnKey struct{}
+
 // listener listens for websocket connections and converts them to net.Conn.
 type listener struct {
 	// underlying listener
@@ -23,25 +50,189 @@ type listener struct {
 	connections chan net.Conn
 	// closed is closed when srv is closed.
 	closed chan struct{}
+	// done is closed once the listener stops handing out connections. It's closed along with closed,
+	// unless the listener is shutting down, in which case it's closed once Shutdown returns.
+	done     chan struct{}
+	doneOnce sync.Once
+	// shuttingDown is set when Shutdown is called.
+	shuttingDown atomic.Bool
+	// cancelReads aborts the first request reads of connections that haven't sent their first
+	// request yet. It's called when the listener is closed, or when a shutdown gives up waiting.
+	cancelReads context.CancelFunc
+	// handshakes tracks the connections still sending their first request, which Shutdown waits for
+	// before shutting down srv, since srv drops requests it finishes reading after that.
+	handshakes *handshakeTracker
+	// handlers tracks the handleFunc calls in progress, which Shutdown waits for.
+	handlers sync.WaitGroup
 	// wsConnErrC is a channel that will receive any errors from srv when accepting a websocket
 	// connection.
 	wsConnErrC chan error
+	// droppedErrs is the number of errors dropped because wsConnErrC was full.
+	droppedErrs atomic.Uint64
 	// srvErr will hold any error explaining why the server was closed.
 	srvErr    error
 	tlsConfig *tls.Config
+	// wsTransport is used to accept websocket connections.
+	wsTransport WSTransport
+	// allowedHosts is the set of hosts that requests may be made to. If empty, all hosts are allowed.
+	allowedHosts []string
+	// busyTimeout is how long a connection waits to be handed out by Accept before it's closed as
+	// busy. If zero, connections wait until the listener is closed.
+	busyTimeout time.Duration
+	// acceptTimeout is how long Accept waits for a connection. If zero, Accept waits until the
+	// listener is closed.
+	acceptTimeout time.Duration
+	// keepAlive is how often accepted connections ping the client. If zero, no pings are sent.
+	keepAlive time.Duration
+	// rateLimiter limits connections per client IP. If nil, connections are not limited.
+	rateLimiter *ipRateLimiter
+	// clock is used for acceptTimeout, busyTimeout, and keep-alives.
+	clock clock
+	// metrics, if not nil, is told about each error sent to wsConnErrC.
+	metrics Metrics
+	// logger, if not nil, logs each connection error, including those dropped from wsConnErrC.
+	logger *slog.Logger
 }
 
-// WrapListener wraps l in a net.Listener to handle requests sent by a lantern-algeneva client.
+// WrapListenerOpts contains options for WrapListenerWithOpts.
+type WrapListenerOpts struct {
+	// TLSConfig, if not nil, is used to establish a TLS connection with the client over the
+	// websocket connection.
+	TLSConfig *tls.Config
+	// WSTransport is the websocket implementation used to accept the handshake. If nil,
+	// nhooyr.io/websocket is used.
+	WSTransport WSTransport
+	// CompressionMode is the websocket permessage-deflate mode accepted in the handshake. The
+	// extension is only used if the client offers it too. The zero value,
+	// websocket.CompressionDisabled, refuses it. Ignored if WSTransport is set.
+	CompressionMode websocket.CompressionMode
+	// AllowedHosts, if not empty, is the set of hosts the normalized request's Host header must
+	// match. An entry of the form "*.example.com" matches any subdomain of example.com. Requests to
+	// any other host are answered with 404 Not Found, as if by an ordinary web server, and
+	// ErrHostNotAllowed is sent on the error channel. Matching is case-insensitive and ignores the
+	// port.
+	AllowedHosts []string
+	// PerIPRateLimit, if Connections and Window are greater than zero, limits the number of
+	// connections accepted from a single client IP, keyed on the connection's remote address.
+	// Connections over the limit are answered with 404 Not Found and ErrRateLimited is sent on the
+	// error channel.
+	PerIPRateLimit RateLimit
+	// BusyTimeout, if greater than zero, is how long an accepted connection waits for the listener's
+	// Accept to be called. If it elapses, the connection is closed with a busy signal, so reads on
+	// the client return ErrServerBusy rather than an ambiguous error, and ErrServerBusy is sent on
+	// the error channel. If zero, connections wait until the listener is closed.
+	BusyTimeout time.Duration
+	// PoolBuffers causes the buffers used to normalize each connection's first request to be reused
+	// across connections rather than allocated per connection, reducing garbage under high
+	// connection rates. The number of buffers is unbounded.
+	PoolBuffers bool
+	// MaxBuffers, if greater than zero, is the fixed number of buffers shared by all connections to
+	// normalize their first request, which bounds the memory used no matter how many connections
+	// are open. The tradeoff is that a connection must wait for a buffer to be free before its first
+	// request is read, so a burst of slow clients can delay others. Takes precedence over
+	// PoolBuffers.
+	MaxBuffers int
+	// MaxHeaderBytes is the maximum number of bytes read from a connection while waiting for the end
+	// of its first request's headers. If exceeded, the connection fails with ErrHeaderTooLarge. If
+	// zero, DefaultMaxHeaderBytes is used.
+	MaxHeaderBytes int
+	// AcceptTimeout, if greater than zero, is how long Accept waits for a connection before
+	// returning ErrAcceptTimeout, so servers with a single accept loop can do other work between
+	// accepts. Connections that arrive after a timeout are handed out by the next call to Accept.
+	AcceptTimeout time.Duration
+	// KeepAlive, if greater than zero, is how often a websocket ping is sent on each accepted
+	// connection. If the client doesn't respond within KeepAlive, the connection is closed. Pongs
+	// are only received while the connection is being read from. Ignored if the WSTransport doesn't
+	// support pings.
+	KeepAlive time.Duration
+	// FirstRequestTimeout, if greater than zero, is how long a client has to send the headers of its
+	// first request before the connection fails with ErrFirstRequestTimeout. It guards against
+	// clients that trickle the headers in to tie up the server. Once the headers are read, the
+	// timeout no longer applies.
+	FirstRequestTimeout time.Duration
+	// OnNormalize, if not nil, is called with the first request of each connection as received and
+	// as normalized, which helps diagnose strategies that produce requests the server can't
+	// recover. normalized is nil if normalization failed. Both are copies the callback may keep.
+	OnNormalize func(original, normalized []byte)
+	// Metrics, if not nil, is told about the normalization of each connection's first request and
+	// about each error sent on the error channel.
+	Metrics Metrics
+	// Logger, if not nil, logs each error sent on the error channel along with the client's remote
+	// address and the stage of the handshake that failed. Errors dropped because the channel was
+	// full are logged too, so they aren't lost.
+	Logger *slog.Logger
+	// clock is used by time-based features. If nil, the real clock is used.
+	clock clock
+}
+
+// Listener is the net.Listener returned by WrapListener and WrapListenerWithOpts.
+type Listener interface {
+	net.Listener
+	// Shutdown gracefully shuts down the listener, mirroring http.Server.Shutdown. It stops
+	// accepting new connections, then waits for the websocket handshakes in progress to complete
+	// and for the resulting connections to be handed out by Accept, so Accept must keep being
+	// called until Shutdown returns. If ctx is done first, the remaining handshakes are abandoned,
+	// their connections are closed, and ctx's error is returned. Once Shutdown returns, Accept
+	// returns ErrListenerClosed. As with Close, connections already handed out are not closed.
+	Shutdown(ctx context.Context) error
+	// DroppedErrors returns the number of connection errors that were dropped because the error
+	// channel returned along with the listener was full.
+	DroppedErrors() uint64
+}
+
+// WrapListener wraps l in a Listener to handle requests sent by a lantern-algeneva client.
 // WrapListener returns the wrapped listener and a channel to receive any errors encountered when
-// a client tries to connect.
-func WrapListener(l net.Listener, tlsConfig *tls.Config) (net.Listener, <-chan error) {
-	l = &innerListener{l}
+// a client tries to connect. Errors are dropped if the channel is full; the number of dropped
+// errors can be read with DroppedErrors. The listener can be shut down gracefully with Shutdown.
+func WrapListener(l net.Listener, tlsConfig *tls.Config) (Listener, <-chan error) {
+	return WrapListenerWithOpts(l, WrapListenerOpts{TLSConfig: tlsConfig})
+}
+
+// WrapListenerWithOpts is like WrapListener but accepts additional options.
+func WrapListenerWithOpts(l net.Listener, opts WrapListenerOpts) (Listener, <-chan error) {
+	wsTransport := opts.WSTransport
+	if wsTransport == nil {
+		wsTransport = nhooyrTransport{compressionMode: opts.CompressionMode}
+	}
+
+	readsCtx, cancelReads := context.WithCancel(context.Background())
+	il := &innerListener{
+		Listener:            l,
+		ctx:                 readsCtx,
+		handshakes:          &handshakeTracker{},
+		clock:               opts.getClock(),
+		maxHeaderBytes:      opts.MaxHeaderBytes,
+		firstRequestTimeout: opts.FirstRequestTimeout,
+		onNormalize:         opts.OnNormalize,
+		metrics:             opts.Metrics,
+	}
+	switch {
+	case opts.MaxBuffers > 0:
+		il.buffers = newFixedBufferPool(opts.MaxBuffers, normalizationBufferSize)
+	case opts.PoolBuffers:
+		il.buffers = newSyncBufferPool()
+	}
+	l = il
 	ll := &listener{
-		listener:    l,
-		connections: make(chan net.Conn),
-		closed:      make(chan struct{}),
-		wsConnErrC:  make(chan error, 20),
-		tlsConfig:   tlsConfig,
+		listener:      l,
+		connections:   make(chan net.Conn),
+		closed:        make(chan struct{}),
+		done:          make(chan struct{}),
+		cancelReads:   cancelReads,
+		handshakes:    il.handshakes,
+		wsConnErrC:    make(chan error, 20),
+		tlsConfig:     opts.TLSConfig,
+		wsTransport:   wsTransport,
+		allowedHosts:  opts.AllowedHosts,
+		busyTimeout:   opts.BusyTimeout,
+		acceptTimeout: opts.AcceptTimeout,
+		keepAlive:     opts.KeepAlive,
+		clock:         opts.getClock(),
+		metrics:       opts.Metrics,
+		logger:        opts.Logger,
+	}
+	if opts.PerIPRateLimit.Connections > 0 && opts.PerIPRateLimit.Window > 0 {
+		ll.rateLimiter = newIPRateLimiter(opts.PerIPRateLimit, opts.getClock())
 	}
 
 	// Start a server to accept websocket connections and convert them to a normalizationConn.
@@ -52,10 +243,19 @@ func WrapListener(l net.Listener, tlsConfig *tls.Config) (net.Listener, <-chan e
 		Handler:      http.HandlerFunc(ll.handleFunc),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, baseConnKey{}, c)
+		},
 	}
 	go func() {
 		ll.srvErr = srv.Serve(l)
+		if !ll.shuttingDown.Load() {
+			ll.cancelReads()
+		}
 		close(ll.closed)
+		if !ll.shuttingDown.Load() {
+			ll.closeDone()
+		}
 	}()
 
 	ll.srv = srv
@@ -66,11 +266,22 @@ func WrapListener(l net.Listener, tlsConfig *tls.Config) (net.Listener, <-chan e
 // Accept implements net.Listener. It is the caller's responsibility to close the connection when
 // done.
 func (ll *listener) Accept() (net.Conn, error) {
+	var timeout <-chan time.Time
+	if ll.acceptTimeout > 0 {
+		t := ll.clock.NewTimer(ll.acceptTimeout)
+		defer t.Stop()
+		timeout = t.C()
+	}
+
+	// Connections are handed over on an unbuffered channel, so a connection is never lost to the
+	// timeout; if it isn't received here, it waits for the next call to Accept.
 	select {
 	case c := <-ll.connections:
 		return c, nil
-	case <-ll.closed:
-		return nil, ll.srvErr
+	case <-ll.done:
+		return nil, ll.closeErr()
+	case <-timeout:
+		return nil, ErrAcceptTimeout
 	}
 }
 
@@ -83,56 +294,295 @@ func (ll *listener) Close() error {
 	case <-ll.closed:
 		return nil
 	default:
+		ll.cancelReads()
 		return ll.srv.Close()
 	}
 }
 
+// Shutdown implements Listener. Connections still sending their first request are waited for like
+// any other handshake.
+func (ll *listener) Shutdown(ctx context.Context) error {
+	ll.shuttingDown.Store(true)
+	ll.listener.(*innerListener).draining.Store(true)
+	defer func() {
+		<-ll.closed
+		ll.cancelReads()
+		ll.closeDone()
+	}()
+
+	// srv.Shutdown drops any request it hasn't finished reading, so first let the clients still
+	// sending their first request get it to a handler.
+	err := ll.handshakes.wait(ctx)
+	if err == nil {
+		// srv.Shutdown only waits for requests that haven't been hijacked, so once it returns no new
+		// handlers can start, but upgraded connections may still be waiting to be handed out.
+		err = ll.srv.Shutdown(ctx)
+	}
+	if err == nil {
+		handlersDone := make(chan struct{})
+		go func() {
+			ll.handlers.Wait()
+			close(handlersDone)
+		}()
+
+		select {
+		case <-handlersDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	if err != nil {
+		ll.cancelReads()
+		ll.srv.Close()
+	}
+
+	return err
+}
+
+// getClock returns opts.clock, or the real clock if it is nil.
+func (opts WrapListenerOpts) getClock() clock {
+	if opts.clock == nil {
+		return realClock{}
+	}
+
+	return opts.clock
+}
+
+// closeDone closes ll.done if it isn't already closed.
+func (ll *listener) closeDone() {
+	ll.doneOnce.Do(func() { close(ll.done) })
+}
+
+// closeErr returns the error Accept returns once the listener is done. It waits for srv to close so
+// that ll.srvErr is set.
+func (ll *listener) closeErr() error {
+	<-ll.closed
+	if errors.Is(ll.srvErr, http.ErrServerClosed) {
+		return fmt.Errorf("%w: %w", ErrListenerClosed, ll.srvErr)
+	}
+
+	return ll.srvErr
+}
+
 // Addr implements net.Listener.
 func (ll *listener) Addr() net.Addr {
 	return ll.listener.Addr()
 }
 
+// DroppedErrors implements Listener.
+func (ll *listener) DroppedErrors() uint64 {
+	return ll.droppedErrs.Load()
+}
+
 // handleFunc handles websocket connections and converts them to net.Conn. Any errors encountered
 // during the process will be sent to ll.wsConnErrC.
 func (ll *listener) handleFunc(w http.ResponseWriter, r *http.Request) {
-	wsc, err := websocket.Accept(w, r, nil)
+	ll.handlers.Add(1)
+	defer ll.handlers.Done()
+
+	// The request has reached the handler, so Shutdown no longer needs to wait for it to be read.
+	if nc, ok := r.Context().Value(baseConnKey{}).(*normalizationConn); ok {
+		nc.endHandshake()
+	}
+
+	if ll.rateLimiter != nil && !ll.rateLimiter.allow(r.RemoteAddr) {
+		http.NotFound(w, r)
+		ll.connError(r, "rate limit", fmt.Errorf("%w: %s", ErrRateLimited, r.RemoteAddr))
+		return
+	}
+
+	if !hostAllowed(r.Host, ll.allowedHosts) {
+		http.NotFound(w, r)
+		ll.connError(r, "host", fmt.Errorf("%w: %q", ErrHostNotAllowed, r.Host))
+		return
+	}
+
+	wsc, err := ll.wsTransport.Accept(w, r)
 	if err != nil {
-		sendError(err, ll.wsConnErrC)
+		ll.connError(r, "websocket", err)
 		return
 	}
 
-	c := websocket.NetConn(context.Background(), wsc, websocket.MessageBinary)
+	if nc, ok := wsc.(*nhooyrConn); ok {
+		nc.base, _ = r.Context().Value(baseConnKey{}).(net.Conn)
+	}
+
+	if ka, ok := wsc.(keepAliver); ok && ll.keepAlive > 0 {
+		ka.KeepAlive(ll.keepAlive, ll.clock)
+	}
+
+	c := wsc
 	if ll.tlsConfig != nil {
 		c = tls.Server(c, ll.tlsConfig)
 	}
 
-	// Wait for someone to call ll.Accept to hand out the connection or for the server to close.
+	var busy <-chan time.Time
+	if ll.busyTimeout > 0 {
+		t := ll.clock.NewTimer(ll.busyTimeout)
+		defer t.Stop()
+		busy = t.C()
+	}
+
+	// Wait for someone to call ll.Accept to hand out the connection, for the listener to be done, or
+	// for the busy timeout to elapse.
 	select {
 	case ll.connections <- c:
-	case <-ll.closed:
+	case <-ll.done:
 		c.Close()
+	case <-busy:
+		// The busy signal is sent on the websocket connection, so it reaches the client even if the
+		// TLS handshake hasn't started.
+		if bc, ok := wsc.(busyCloser); ok {
+			bc.CloseBusy()
+		} else {
+			wsc.Close()
+		}
+		ll.connError(r, "busy", ErrServerBusy)
+	}
+}
+
+// connError reports err, which occurred during stage of handling r, on ll.wsConnErrC and to
+// ll.logger.
+func (ll *listener) connError(r *http.Request, stage string, err error) {
+	sent := ll.sendError(err)
+	if ll.logger != nil {
+		ll.logger.LogAttrs(r.Context(), slog.LevelWarn, "genevahttp: connection failed",
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("stage", stage),
+			slog.Any("error", err),
+			slog.Bool("dropped", !sent),
+		)
 	}
 }
 
-// sendError sends err to c if c is not full. If c is full, the error is dropped.
-func sendError(err error, c chan<- error) {
+// sendError sends err to ll.wsConnErrC if it is not full and reports whether it was sent. If
+// ll.wsConnErrC is full, the error is dropped and counted in ll.droppedErrs.
+func (ll *listener) sendError(err error) bool {
+	if ll.metrics != nil {
+		ll.metrics.ListenerError(err)
+	}
+
 	select {
-	case c <- err:
+	case ll.wsConnErrC <- err:
+		return true
 	default:
+		ll.droppedErrs.Add(1)
+		return false
 	}
 }
 
+// hostAllowed reports whether host matches any of allowed. Entries of the form "*.example.com"
+// match any subdomain of example.com. If allowed is empty, all hosts are allowed.
+func hostAllowed(host string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if suffix, ok := strings.CutPrefix(a, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == a {
+			return true
+		}
+	}
+
+	return false
+}
+
 // innerListener is a net.Listener that wraps connections in a normalizationConn.
 type innerListener struct {
 	net.Listener
+	// buffers, if not nil, provides the buffers for the normalizationConns.
+	buffers bufferPool
+	// ctx, handshakes, clock, maxHeaderBytes, firstRequestTimeout, onNormalize, and metrics are
+	// passed to the normalizationConns.
+	ctx                 context.Context
+	handshakes          *handshakeTracker
+	clock               clock
+	maxHeaderBytes      int
+	firstRequestTimeout time.Duration
+	onNormalize         func(original, normalized []byte)
+	metrics             Metrics
+	// draining is set when the listener starts shutting down. New connections are closed as soon as
+	// they're accepted.
+	draining atomic.Bool
 }
 
 // Accept implements net.Listener and wraps the connection in a normalizationConn.
 func (il *innerListener) Accept() (net.Conn, error) {
 	c, err := il.Listener.Accept()
+	for err == nil && il.draining.Load() {
+		c.Close()
+		c, err = il.Listener.Accept()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &normalizationConn{Conn: c}, nil
+	return &normalizationConn{
+		Conn:                c,
+		ctx:                 il.ctx,
+		handshakes:          il.handshakes,
+		clock:               il.clock,
+		buffers:             il.buffers,
+		maxHeaderBytes:      il.maxHeaderBytes,
+		firstRequestTimeout: il.firstRequestTimeout,
+		onNormalize:         il.onNormalize,
+		metrics:             il.metrics,
+	}, nil
+}
+
+// handshakeTracker counts the connections that are in the middle of sending their first request.
+type handshakeTracker struct {
+	mx sync.Mutex
+	n  int
+	// idle, if not nil, is closed once n drops to zero.
+	idle chan struct{}
+}
+
+func (t *handshakeTracker) add() {
+	t.mx.Lock()
+	t.n++
+	t.mx.Unlock()
+}
+
+func (t *handshakeTracker) done() {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.n--
+	if t.n == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// wait waits until no connections are being tracked or ctx is done, in which case it returns ctx's
+// error.
+func (t *handshakeTracker) wait(ctx context.Context) error {
+	t.mx.Lock()
+	if t.n == 0 {
+		t.mx.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mx.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
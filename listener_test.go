@@ -0,0 +1,321 @@
+package genevahttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerDroppedErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	wl, errC := WrapListener(l, nil)
+	defer wl.Close()
+
+	ll := wl.(*listener)
+	for i := 0; i < cap(errC)+5; i++ {
+		ll.sendError(errors.New("handshake failed"))
+	}
+
+	assert.Len(t, errC, cap(errC))
+	assert.Equal(t, uint64(5), ll.DroppedErrors())
+}
+
+func TestHostAllowed(t *testing.T) {
+	allowed := []string{"example.com", "*.fronted.net"}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "example.com", want: true},
+		{host: "EXAMPLE.com:443", want: true},
+		{host: "example.com.", want: true},
+		{host: "www.example.com", want: false},
+		{host: "other.org", want: false},
+		{host: "cdn.fronted.net", want: true},
+		{host: "a.b.fronted.net:80", want: true},
+		{host: "fronted.net", want: false},
+		{host: "evilfronted.net", want: false},
+		{host: "", want: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, hostAllowed(tt.host, allowed), tt.host)
+	}
+
+	assert.True(t, hostAllowed("anything", nil), "all hosts should be allowed if the list is empty")
+}
+
+func TestListenerAllowedHosts(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	wl, errC := WrapListenerWithOpts(l, WrapListenerOpts{AllowedHosts: []string{"example.com"}})
+	defer wl.Close()
+
+	_, err = Dial("tcp", l.Addr().String(), DialerOpts{})
+	require.Error(t, err, "dial to a host that isn't allowed should fail")
+	assert.ErrorIs(t, <-errC, ErrHostNotAllowed)
+}
+
+func TestListenerBusyTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	// Nobody calls Accept, so the connection is closed as busy.
+	clk := newFakeClock()
+	wl, errC := WrapListenerWithOpts(l, WrapListenerOpts{BusyTimeout: time.Minute, clock: clk})
+	defer wl.Close()
+
+	c, err := Dial("tcp", l.Addr().String(), DialerOpts{})
+	require.NoError(t, err)
+	defer c.Close()
+
+	clk.waitForTimers(1)
+	clk.Advance(time.Minute)
+	_, err = c.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrServerBusy)
+	assert.ErrorIs(t, <-errC, ErrServerBusy)
+}
+
+func TestListenerAcceptTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	clk := newFakeClock()
+	wl, _ := WrapListenerWithOpts(l, WrapListenerOpts{AcceptTimeout: time.Minute, clock: clk})
+	defer wl.Close()
+
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := wl.Accept()
+		acceptErr <- err
+	}()
+	clk.waitForTimers(1)
+	clk.Advance(time.Minute)
+	err = <-acceptErr
+	assert.ErrorIs(t, err, ErrAcceptTimeout)
+	var ne net.Error
+	require.ErrorAs(t, err, &ne)
+	assert.True(t, ne.Timeout())
+
+	// The handshake completes without anyone calling Accept, so the connection is handed out even
+	// though the next Accept starts after it arrived.
+	c, err := Dial("tcp", l.Addr().String(), DialerOpts{})
+	require.NoError(t, err)
+	defer c.Close()
+
+	sc, err := wl.Accept()
+	require.NoError(t, err)
+	go sc.Close()
+}
+
+func TestListenerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	wl, _ := WrapListener(l, nil)
+	defer wl.Close()
+
+	// The handshake completes, but the connection hasn't been handed out by Accept yet.
+	c, err := Dial("tcp", l.Addr().String(), DialerOpts{})
+	require.NoError(t, err)
+	defer c.Close()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- wl.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before the connection was handed out: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	sc, err := wl.Accept()
+	require.NoError(t, err, "in-flight connection should be handed out during shutdown")
+
+	go func() {
+		sc.Write([]byte("ping"))
+		sc.Close()
+	}()
+	b := make([]byte, 4)
+	_, err = io.ReadFull(c, b)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+
+	require.NoError(t, <-shutdownErr)
+
+	_, err = wl.Accept()
+	assert.ErrorIs(t, err, ErrListenerClosed)
+	_, err = Dial("tcp", l.Addr().String(), DialerOpts{})
+	assert.Error(t, err, "new connections should be refused after shutdown")
+}
+
+func TestListenerShutdownContextDone(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	wl, _ := WrapListener(l, nil)
+	defer wl.Close()
+
+	c, err := Dial("tcp", l.Addr().String(), DialerOpts{})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Nobody calls Accept, so the in-flight connection is abandoned once ctx is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = wl.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = c.Read(make([]byte, 1))
+	assert.Error(t, err, "abandoned connection should be closed")
+
+	_, err = wl.Accept()
+	assert.ErrorIs(t, err, ErrListenerClosed)
+}
+
+func TestListenerShutdownFirstRequest(t *testing.T) {
+	t.Run("drained", func(t *testing.T) {
+		l, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+
+		wl, _ := WrapListener(l, nil)
+		defer wl.Close()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			if c, err := wl.Accept(); err == nil {
+				accepted <- c
+			}
+		}()
+
+		// The client is still sending its upgrade request when Shutdown starts, so Shutdown should
+		// wait for it to finish instead of aborting it.
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n"))
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr := make(chan error, 1)
+		go func() { shutdownErr <- wl.Shutdown(ctx) }()
+		time.Sleep(50 * time.Millisecond)
+
+		_, err = c.Write([]byte("Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+		select {
+		case sc := <-accepted:
+			go sc.Close()
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection was not handed out")
+		}
+		require.NoError(t, <-shutdownErr)
+	})
+
+	t.Run("ctx done", func(t *testing.T) {
+		l, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+
+		wl, _ := WrapListener(l, nil)
+		defer wl.Close()
+
+		// The client never finishes its first request, so its read is only aborted once ctx is done.
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		_, err = c.Write([]byte("GET / HTTP/1.1\r\n"))
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		assert.ErrorIs(t, wl.Shutdown(ctx), context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), time.Second)
+
+		_, err = c.Read(make([]byte, 1))
+		assert.Error(t, err, "connection should be closed")
+	})
+}
+
+func TestListenerCloseAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	wl, _ := WrapListener(l, nil)
+	require.NoError(t, wl.Close())
+
+	_, err = wl.Accept()
+	assert.ErrorIs(t, err, ErrListenerClosed)
+}
+
+// syncBuffer is a bytes.Buffer that's safe for concurrent use.
+type syncBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.String()
+}
+
+func TestListenerLogger(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	wl, errC := WrapListenerWithOpts(l, WrapListenerOpts{AllowedHosts: []string{"example.com"}, Logger: logger})
+	defer wl.Close()
+
+	_, err = Dial("tcp", l.Addr().String(), DialerOpts{})
+	require.Error(t, err)
+	require.ErrorIs(t, <-errC, ErrHostNotAllowed)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "stage=host")
+	}, 5*time.Second, time.Millisecond)
+	assert.Contains(t, logs.String(), "remote_addr=127.0.0.1:")
+	assert.Contains(t, logs.String(), "dropped=false")
+
+	// Errors dropped because the channel is full are still logged.
+	ll := wl.(*listener)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < cap(errC); i++ {
+		ll.connError(r, "websocket", errors.New("handshake failed"))
+	}
+	ll.connError(r, "websocket", errors.New("dropped handshake"))
+	assert.Contains(t, logs.String(), `error="dropped handshake" dropped=true`)
+}
@@ -0,0 +1,31 @@
+package genevahttp
+
+import "time"
+
+// Metrics receives events from connections so operators can record them, e.g. as Prometheus
+// counters, without this package depending on a metrics library. It can be set with
+// DialerOpts.Metrics and WrapListenerOpts.Metrics; if nil, no events are reported. Implementations
+// must be safe for concurrent use. Embed NopMetrics to implement only some of the methods.
+type Metrics interface {
+	// FirstRequestTransformed is called by the client once the first request has been transformed
+	// and written, with the number of bytes buffered before the geneva strategy was applied and how
+	// long they were buffered.
+	FirstRequestTransformed(bytesBuffered int, dur time.Duration)
+	// FirstRequestNormalized is called by the server once the first request of a connection has
+	// been normalized, with how long it took to read and normalize.
+	FirstRequestNormalized(dur time.Duration)
+	// NormalizeFailed is called by the server when reading or normalizing the first request of a
+	// connection fails.
+	NormalizeFailed(err error)
+	// ListenerError is called by the server with each error sent on the listener's error channel,
+	// including errors dropped because the channel was full.
+	ListenerError(err error)
+}
+
+// NopMetrics is a Metrics that ignores all events.
+type NopMetrics struct{}
+
+func (NopMetrics) FirstRequestTransformed(int, time.Duration) {}
+func (NopMetrics) FirstRequestNormalized(time.Duration)       {}
+func (NopMetrics) NormalizeFailed(error)                      {}
+func (NopMetrics) ListenerError(error)                        {}
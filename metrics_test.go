@@ -0,0 +1,123 @@
+package genevahttp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/algeneva"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMetrics is a Metrics that records the events it receives.
+type recordingMetrics struct {
+	mx             sync.Mutex
+	transformed    []int
+	transformDurs  []time.Duration
+	normalizeDurs  []time.Duration
+	normalizeErrs  []error
+	listenerErrors []error
+}
+
+func (m *recordingMetrics) FirstRequestTransformed(bytesBuffered int, dur time.Duration) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.transformed = append(m.transformed, bytesBuffered)
+	m.transformDurs = append(m.transformDurs, dur)
+}
+
+func (m *recordingMetrics) FirstRequestNormalized(dur time.Duration) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.normalizeDurs = append(m.normalizeDurs, dur)
+}
+
+func (m *recordingMetrics) NormalizeFailed(err error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.normalizeErrs = append(m.normalizeErrs, err)
+}
+
+func (m *recordingMetrics) ListenerError(err error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.listenerErrors = append(m.listenerErrors, err)
+}
+
+var _ Metrics = NopMetrics{}
+
+func TestMetricsFirstRequestTransformed(t *testing.T) {
+	s, err := algeneva.NewHTTPStrategy(testStrategy(t, "China", 17))
+	require.NoError(t, err)
+
+	clk := newFakeClock()
+	m := &recordingMetrics{}
+	htc := &httpTransformConn{Conn: &recordingConn{}, httpTransform: s, metrics: m, clock: clk}
+
+	_, err = htc.Write([]byte("GET / HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, m.transformed, "request isn't transformed until the headers are complete")
+
+	clk.Advance(time.Second)
+	_, err = htc.Write([]byte("Host: example.com\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []int{len("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")}, m.transformed)
+	assert.Equal(t, []time.Duration{time.Second}, m.transformDurs)
+
+	_, err = htc.Write([]byte("more"))
+	require.NoError(t, err)
+	assert.Len(t, m.transformed, 1, "later writes should not be reported")
+}
+
+func TestMetricsNormalization(t *testing.T) {
+	clk := newFakeClock()
+	m := &recordingMetrics{}
+	nc := &normalizationConn{
+		Conn: &readerConn{r: bytes.NewReader([]byte(testRequest))},
+		normalize: func(req []byte) ([]byte, error) {
+			clk.Advance(time.Second)
+			return normalizeRequest(req)
+		},
+		metrics: m,
+		clock:   clk,
+	}
+	_, err := nc.Read(make([]byte, 1024))
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{time.Second}, m.normalizeDurs)
+	assert.Empty(t, m.normalizeErrs)
+
+	normErr := errors.New("bad request")
+	nc = &normalizationConn{
+		Conn:      &readerConn{r: bytes.NewReader([]byte(testRequest))},
+		normalize: func([]byte) ([]byte, error) { return nil, normErr },
+		metrics:   m,
+	}
+	_, err = nc.Read(make([]byte, 1024))
+	require.Error(t, err)
+	assert.Len(t, m.normalizeDurs, 1)
+	require.Len(t, m.normalizeErrs, 1)
+	assert.ErrorIs(t, m.normalizeErrs[0], normErr)
+	assert.ErrorIs(t, m.normalizeErrs[0], ErrNormalization)
+}
+
+func TestMetricsListenerError(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	m := &recordingMetrics{}
+	wl, errC := WrapListenerWithOpts(l, WrapListenerOpts{AllowedHosts: []string{"example.com"}, Metrics: m})
+	defer wl.Close()
+
+	_, err = Dial("tcp", l.Addr().String(), DialerOpts{})
+	require.Error(t, err)
+	require.ErrorIs(t, <-errC, ErrHostNotAllowed)
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	require.Len(t, m.listenerErrors, 1)
+	assert.ErrorIs(t, m.listenerErrors[0], ErrHostNotAllowed)
+}
@@ -0,0 +1,79 @@
+package genevahttp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is sent on the error channel returned by WrapListenerWithOpts when a connection is
+// rejected because its client IP exceeded WrapListenerOpts.PerIPRateLimit.
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimit limits the number of connections accepted in a fixed window of time.
+type RateLimit struct {
+	// Connections is the maximum number of connections accepted per Window.
+	Connections int
+	// Window is the length of each window.
+	Window time.Duration
+}
+
+// ipRateLimiter counts connections per client IP in fixed windows.
+type ipRateLimiter struct {
+	limit RateLimit
+	clock clock
+
+	mx sync.Mutex
+	// windows maps a client IP to its current window.
+	windows map[string]*rateWindow
+	// lastSweep is the last time expired windows were removed from windows.
+	lastSweep time.Time
+}
+
+// rateWindow is the number of connections seen from a client IP since start.
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newIPRateLimiter(limit RateLimit, clk clock) *ipRateLimiter {
+	return &ipRateLimiter{
+		limit:     limit,
+		clock:     clk,
+		windows:   make(map[string]*rateWindow),
+		lastSweep: clk.Now(),
+	}
+}
+
+// allow records a connection from addr and reports whether it is within the limit. addr may be a
+// "host:port" address or a bare IP.
+func (rl *ipRateLimiter) allow(addr string) bool {
+	ip := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip = host
+	}
+
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+
+	now := rl.clock.Now()
+	if now.Sub(rl.lastSweep) >= rl.limit.Window {
+		// Remove expired windows so the map doesn't grow with every client ever seen.
+		for k, w := range rl.windows {
+			if now.Sub(w.start) >= rl.limit.Window {
+				delete(rl.windows, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	w, ok := rl.windows[ip]
+	if !ok || now.Sub(w.start) >= rl.limit.Window {
+		w = &rateWindow{start: now}
+		rl.windows[ip] = w
+	}
+
+	w.count++
+	return w.count <= rl.limit.Connections
+}
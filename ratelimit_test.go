@@ -0,0 +1,56 @@
+package genevahttp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPRateLimiter(t *testing.T) {
+	clk := newFakeClock()
+	rl := newIPRateLimiter(RateLimit{Connections: 2, Window: time.Minute}, clk)
+
+	assert.True(t, rl.allow("10.0.0.1:1000"))
+	assert.True(t, rl.allow("10.0.0.1:1001"))
+	assert.False(t, rl.allow("10.0.0.1:1002"), "third connection in the window should be limited")
+	assert.True(t, rl.allow("10.0.0.2:1000"), "other IPs should not be limited")
+
+	clk.Advance(time.Minute)
+	assert.True(t, rl.allow("10.0.0.1:1003"), "limit should reset in the next window")
+	assert.Len(t, rl.windows, 1, "expired windows should be removed")
+}
+
+func TestListenerPerIPRateLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	clk := newFakeClock()
+	wl, errC := WrapListenerWithOpts(l, WrapListenerOpts{
+		PerIPRateLimit: RateLimit{Connections: 3, Window: time.Hour},
+		clock:          clk,
+	})
+	defer wl.Close()
+	go acceptAndClose(wl)
+
+	var failed int
+	for i := 0; i < 10; i++ {
+		c, err := Dial("tcp", l.Addr().String(), DialerOpts{})
+		if err != nil {
+			failed++
+			continue
+		}
+		c.Close()
+	}
+
+	assert.Equal(t, 7, failed, "connections over the limit should be rejected")
+	require.NotEmpty(t, errC)
+	assert.ErrorIs(t, <-errC, ErrRateLimited)
+
+	clk.Advance(time.Hour)
+	c, err := Dial("tcp", l.Addr().String(), DialerOpts{})
+	require.NoError(t, err, "limit should reset in the next window")
+	c.Close()
+}
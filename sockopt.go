@@ -0,0 +1,55 @@
+package genevahttp
+
+import (
+	"context"
+	"log/slog"
+	"syscall"
+)
+
+// sockBufOption identifies a socket buffer size option.
+type sockBufOption int
+
+const (
+	// sockRcvBuf is the receive buffer size option, SO_RCVBUF.
+	sockRcvBuf sockBufOption = iota
+	// sockSndBuf is the send buffer size option, SO_SNDBUF.
+	sockSndBuf
+)
+
+func (o sockBufOption) String() string {
+	if o == sockRcvBuf {
+		return "SO_RCVBUF"
+	}
+	return "SO_SNDBUF"
+}
+
+// bufferSizeControl returns a net.Dialer Control function that sets the receive and send buffer
+// sizes of the socket to readSize and writeSize using setBuf. Sizes less than or equal to zero are
+// left at the system default. Setting the buffer sizes is best-effort; failures are logged to
+// logger, if not nil, and the dial continues with the default sizes.
+func bufferSizeControl(
+	readSize, writeSize int,
+	setBuf func(fd uintptr, opt sockBufOption, size int) error,
+	logger *slog.Logger,
+) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		set := func(fd uintptr, opt sockBufOption, size int) {
+			if err := setBuf(fd, opt, size); err != nil && logger != nil {
+				logger.LogAttrs(context.Background(), slog.LevelWarn, "genevahttp: setting socket buffer size failed",
+					slog.String("address", address),
+					slog.String("option", opt.String()),
+					slog.Int("size", size),
+					slog.Any("error", err),
+				)
+			}
+		}
+		return c.Control(func(fd uintptr) {
+			if readSize > 0 {
+				set(fd, sockRcvBuf, readSize)
+			}
+			if writeSize > 0 {
+				set(fd, sockSndBuf, writeSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package genevahttp
+
+import "errors"
+
+// setSockBuf is not supported on this platform.
+func setSockBuf(fd uintptr, opt sockBufOption, size int) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,76 @@
+package genevahttp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockRawConn struct {
+	syscall.RawConn
+	fd uintptr
+}
+
+func (c *mockRawConn) Control(f func(fd uintptr)) error {
+	f(c.fd)
+	return nil
+}
+
+func TestBufferSizeControl(t *testing.T) {
+	got := map[sockBufOption]int{}
+	setBuf := func(fd uintptr, opt sockBufOption, size int) error {
+		assert.Equal(t, uintptr(42), fd)
+		got[opt] = size
+		return nil
+	}
+
+	control := bufferSizeControl(1<<20, 1<<19, setBuf, nil)
+	require.NoError(t, control("tcp", "127.0.0.1:80", &mockRawConn{fd: 42}))
+	assert.Equal(t, map[sockBufOption]int{sockRcvBuf: 1 << 20, sockSndBuf: 1 << 19}, got)
+
+	got = map[sockBufOption]int{}
+	control = bufferSizeControl(0, 1<<19, setBuf, nil)
+	require.NoError(t, control("tcp", "127.0.0.1:80", &mockRawConn{fd: 42}))
+	assert.Equal(t, map[sockBufOption]int{sockSndBuf: 1 << 19}, got)
+}
+
+func TestBufferSizeControlLogsFailures(t *testing.T) {
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	setBuf := func(fd uintptr, opt sockBufOption, size int) error {
+		if opt == sockRcvBuf {
+			return errors.New("operation not permitted")
+		}
+		return nil
+	}
+
+	control := bufferSizeControl(1<<20, 1<<19, setBuf, logger)
+	require.NoError(t, control("tcp", "127.0.0.1:80", &mockRawConn{fd: 42}), "failures shouldn't fail the dial")
+	assert.Contains(t, logs.String(), `level=WARN msg="genevahttp: setting socket buffer size failed" address=127.0.0.1:80 option=SO_RCVBUF size=1048576 error="operation not permitted"`)
+	assert.NotContains(t, logs.String(), "SO_SNDBUF")
+
+	// Without a logger, failures are ignored.
+	control = bufferSizeControl(1<<20, 0, setBuf, nil)
+	assert.NoError(t, control("tcp", "127.0.0.1:80", &mockRawConn{fd: 42}))
+}
+
+func TestBaseDialerBufferSizes(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	dialer := baseDialer(DialerOpts{ReadBufferSize: 1 << 20, WriteBufferSize: 1 << 20})
+	require.NotNil(t, dialer.(*net.Dialer).Control)
+
+	c, err := dialer.DialContext(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	c.Close()
+
+	assert.Nil(t, baseDialer(DialerOpts{}).(*net.Dialer).Control)
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package genevahttp
+
+import "syscall"
+
+// setSockBuf sets the socket buffer size option, opt, of fd to size.
+func setSockBuf(fd uintptr, opt sockBufOption, size int) error {
+	name := syscall.SO_RCVBUF
+	if opt == sockSndBuf {
+		name = syscall.SO_SNDBUF
+	}
+
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, name, size)
+}
@@ -0,0 +1,169 @@
+package genevahttp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 protocol values, as defined in RFC 1928.
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthNotAccepted  = 0xff
+	socks5CmdConnect       = 0x01
+	socks5AddrIPv4         = 0x01
+	socks5AddrDomain       = 0x03
+	socks5AddrIPv6         = 0x04
+	socks5ReplySucceeded   = 0x00
+	socks5ReplyRefused     = 0x05
+	socks5ReplyCmdNotSupp  = 0x07
+	socks5ReplyAddrNotSupp = 0x08
+)
+
+// errSOCKS5 is wrapped by errors caused by a malformed SOCKS5 handshake.
+var errSOCKS5 = errors.New("socks5")
+
+// ServeSOCKS5 runs a local SOCKS5 server on listenAddr so applications that speak SOCKS5 can use
+// the tunnel without code changes. Each CONNECT request is tunneled to the geneva server at
+// serverAddr, dialed with DialContext using opts, which then connects to the requested address;
+// the server must be running ServeTunnel. Once connected, data is copied in both directions until
+// either side closes. Only CONNECT without authentication is supported. ServeSOCKS5 blocks until
+// accepting a connection fails.
+func ServeSOCKS5(listenAddr, serverAddr string, opts DialerOpts) error {
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	return serveSOCKS5(l, serverAddr, opts)
+}
+
+// serveSOCKS5 serves SOCKS5 connections accepted from l. See ServeSOCKS5.
+func serveSOCKS5(l net.Listener, serverAddr string, opts DialerOpts) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go handleSOCKS5(c, serverAddr, opts)
+	}
+}
+
+// handleSOCKS5 performs the SOCKS5 handshake on c, tunnels to the requested address through the
+// server at serverAddr, and splices the two connections together.
+func handleSOCKS5(c net.Conn, serverAddr string, opts DialerOpts) {
+	target, err := readSOCKS5Request(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	up, err := dialTunnel(context.Background(), serverAddr, target, opts)
+	if err != nil {
+		writeSOCKS5Reply(c, socks5ReplyRefused)
+		c.Close()
+		return
+	}
+
+	if err := writeSOCKS5Reply(c, socks5ReplySucceeded); err != nil {
+		c.Close()
+		up.Close()
+		return
+	}
+
+	splice(c, up)
+}
+
+// readSOCKS5Request negotiates the authentication method and reads the CONNECT request from c,
+// returning the requested address. Unsupported requests are answered with the appropriate error
+// reply.
+func readSOCKS5Request(c net.Conn) (string, error) {
+	// Method selection: VER, NMETHODS, METHODS.
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("%w: unsupported version %d", errSOCKS5, hdr[0])
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socks5AuthNotAccepted)
+	for _, m := range methods {
+		if m == socks5AuthNone {
+			method = socks5AuthNone
+		}
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5AuthNotAccepted {
+		return "", fmt.Errorf("%w: no acceptable authentication method", errSOCKS5)
+	}
+
+	// Request: VER, CMD, RSV, ATYP, DST.ADDR, DST.PORT.
+	var req [4]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socks5Version {
+		return "", fmt.Errorf("%w: unsupported version %d", errSOCKS5, req[0])
+	}
+
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, n[0])
+		if _, err := io.ReadFull(c, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		writeSOCKS5Reply(c, socks5ReplyAddrNotSupp)
+		return "", fmt.Errorf("%w: unsupported address type %d", errSOCKS5, req[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return "", err
+	}
+
+	if req[1] != socks5CmdConnect {
+		writeSOCKS5Reply(c, socks5ReplyCmdNotSupp)
+		return "", fmt.Errorf("%w: unsupported command %d", errSOCKS5, req[1])
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeSOCKS5Reply writes a reply with the given status to c. The bound address is always reported
+// as 0.0.0.0:0 since the upstream connection isn't a plain TCP connection.
+func writeSOCKS5Reply(c net.Conn, status byte) error {
+	_, err := c.Write([]byte{socks5Version, status, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
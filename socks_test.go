@@ -0,0 +1,159 @@
+package genevahttp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// socks5Connect performs a no-authentication SOCKS5 handshake on c, requesting a connection to
+// address with cmd, and returns the reply status.
+func socks5Connect(t *testing.T, c net.Conn, cmd byte, address string) byte {
+	t.Helper()
+	host, portStr, err := net.SplitHostPort(address)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	_, err = c.Write([]byte{socks5Version, 1, socks5AuthNone})
+	require.NoError(t, err)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(c, method)
+	require.NoError(t, err)
+	require.Equal(t, []byte{socks5Version, socks5AuthNone}, method)
+
+	req := []byte{socks5Version, cmd, 0x00, socks5AddrDomain, byte(len(host))}
+	req = append(req, host...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	_, err = c.Write(req)
+	require.NoError(t, err)
+
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(c, reply)
+	require.NoError(t, err)
+	return reply[1]
+}
+
+// startSOCKS5 starts a SOCKS5 server that tunnels through the geneva server at serverAddr with opts
+// and returns its address.
+func startSOCKS5(t *testing.T, serverAddr string, opts DialerOpts) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go serveSOCKS5(l, serverAddr, opts)
+	return l.Addr().String()
+}
+
+func TestServeSOCKS5(t *testing.T) {
+	// The target is an ordinary TCP server, reached through the tunnel.
+	target, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer target.Close()
+
+	targetClosed := make(chan struct{})
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+		close(targetClosed)
+	}()
+
+	opts := DialerOpts{AlgenevaStrategy: testStrategy(t, "China", 17)}
+	c, err := net.Dial("tcp", startSOCKS5(t, startTunnelServer(t), opts))
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Equal(t, byte(socks5ReplySucceeded), socks5Connect(t, c, socks5CmdConnect, target.Addr().String()))
+
+	_, err = c.Write([]byte("ping"))
+	require.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(c, b)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+
+	c.Close()
+	select {
+	case <-targetClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("target was not closed when downstream closed")
+	}
+}
+
+func TestServeSOCKS5HTTPClient(t *testing.T) {
+	// net/http's SOCKS5 support is a copy of golang.org/x/net/proxy's client, so this checks the
+	// server against an independent implementation without adding a dependency.
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.URL.Path)
+	}))
+	defer target.Close()
+
+	opts := DialerOpts{AlgenevaStrategy: testStrategy(t, "China", 17)}
+	proxyURL := &url.URL{Scheme: "socks5", Host: startSOCKS5(t, startTunnelServer(t), opts)}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+	defer client.CloseIdleConnections()
+
+	port := target.Listener.Addr().(*net.TCPAddr).Port
+	for _, host := range []string{target.Listener.Addr().String(), "localhost:" + strconv.Itoa(port)} {
+		resp, err := client.Get("http://" + host + "/tunnel")
+		require.NoError(t, err, host)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello from /tunnel", string(body))
+	}
+}
+
+func TestServeSOCKS5Errors(t *testing.T) {
+	addr := startSOCKS5(t, startTunnelServer(t), DialerOpts{})
+
+	t.Run("unsupported command", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// BIND isn't supported.
+		assert.Equal(t, byte(socks5ReplyCmdNotSupp), socks5Connect(t, c, 0x02, "example.com:80"))
+	})
+	t.Run("target unreachable", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer c.Close()
+
+		assert.Equal(t, byte(socks5ReplyRefused), socks5Connect(t, c, socks5CmdConnect, closedAddr(t)))
+	})
+	t.Run("server unreachable", func(t *testing.T) {
+		c, err := net.Dial("tcp", startSOCKS5(t, closedAddr(t), DialerOpts{}))
+		require.NoError(t, err)
+		defer c.Close()
+
+		assert.Equal(t, byte(socks5ReplyRefused), socks5Connect(t, c, socks5CmdConnect, "example.com:80"))
+	})
+	t.Run("authentication required", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer c.Close()
+
+		// Only username/password authentication is offered.
+		_, err = c.Write([]byte{socks5Version, 1, 0x02})
+		require.NoError(t, err)
+		method := make([]byte, 2)
+		_, err = io.ReadFull(c, method)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{socks5Version, socks5AuthNotAccepted}, method)
+	})
+}
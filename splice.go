@@ -0,0 +1,37 @@
+package genevahttp
+
+import (
+	"io"
+	"net"
+)
+
+// splice copies data between down and up in both directions. When one side stops sending, the
+// other side's write half is closed if it supports half-closing, e.g. a *net.TCPConn, so data still
+// in flight in the other direction is delivered. The tunnels used by the local proxies support
+// half-closing; other connections that don't, such as the websocket connections returned by
+// DialContext, are closed instead. Both connections are closed once splice returns.
+func splice(down, up net.Conn) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		closeWrite(dst)
+		done <- struct{}{}
+	}
+	go pipe(up, down)
+	go pipe(down, up)
+	<-done
+	<-done
+
+	down.Close()
+	up.Close()
+}
+
+// closeWrite closes the write half of c if it supports it. Otherwise, c is closed.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+
+	c.Close()
+}
@@ -0,0 +1,205 @@
+package genevahttp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/algeneva"
+)
+
+// ErrStrategyNotFound is returned by Strategy if the region is unknown or the index is out of
+// range.
+var ErrStrategyNotFound = errors.New("strategy not found")
+
+// StrategyInfo describes a geneva strategy along with optional metadata about where it is known to
+// work and how it has performed.
+type StrategyInfo struct {
+	// Strategy is the raw geneva strategy string, as used in DialerOpts.AlgenevaStrategy.
+	Strategy string `json:"strategy"`
+	// Region is the region the strategy was found to work in, e.g. "China".
+	Region string `json:"region,omitempty"`
+	// Description is a human readable description of the strategy.
+	Description string `json:"description,omitempty"`
+	// LastSuccess is the last time the strategy was used to connect successfully.
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	// SuccessCount is the number of times the strategy was used to connect successfully.
+	SuccessCount int `json:"successCount,omitempty"`
+}
+
+// NewStrategyInfo returns a StrategyInfo for the raw strategy string with no metadata.
+func NewStrategyInfo(strategy string) StrategyInfo {
+	return StrategyInfo{Strategy: strategy}
+}
+
+// RegionStrategies returns a StrategyInfo for each of the strategies in algeneva.Strategies for
+// region. nil is returned if region is unknown.
+func RegionStrategies(region string) []StrategyInfo {
+	strategies := algeneva.Strategies[region]
+	if len(strategies) == 0 {
+		return nil
+	}
+
+	infos := make([]StrategyInfo, len(strategies))
+	for i, s := range strategies {
+		infos[i] = StrategyInfo{Strategy: s, Region: region}
+	}
+
+	return infos
+}
+
+// Strategy returns the strategy at index in algeneva.Strategies for region. Unlike indexing
+// algeneva.Strategies directly, Strategy returns an error wrapping ErrStrategyNotFound rather than
+// panicking if the strategy doesn't exist, e.g. because the upstream list shrank.
+func Strategy(region string, index int) (string, error) {
+	strategies, ok := algeneva.Strategies[region]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown region %q", ErrStrategyNotFound, region)
+	}
+
+	if index < 0 || index >= len(strategies) {
+		return "", fmt.Errorf("%w: index %d out of range for region %q", ErrStrategyNotFound, index, region)
+	}
+
+	return strategies[index], nil
+}
+
+// RecordSuccess records a successful connection made with the strategy at t.
+func (s *StrategyInfo) RecordSuccess(t time.Time) {
+	s.SuccessCount++
+	if t.After(s.LastSuccess) {
+		s.LastSuccess = t
+	}
+}
+
+// String returns the raw geneva strategy string.
+func (s StrategyInfo) String() string {
+	return s.Strategy
+}
+
+// maxCachedStrategies bounds the number of compiled strategies kept by compileStrategy, in case a
+// caller generates strategies dynamically.
+const maxCachedStrategies = 256
+
+// strategyCache holds the strategies compiled by compileStrategy, keyed by the strategy string.
+var strategyCache = struct {
+	mx sync.RWMutex
+	m  map[string]*algeneva.HTTPStrategy
+}{m: make(map[string]*algeneva.HTTPStrategy)}
+
+// compileStrategy returns strategy compiled with algeneva.NewHTTPStrategy, reusing the result of a
+// previous call with the same strategy so repeated dials don't parse it again. Sharing a compiled
+// strategy between connections is safe since HTTPStrategy.Apply only reads the strategy; each call
+// works on its own copy of the request.
+func compileStrategy(strategy string) (*algeneva.HTTPStrategy, error) {
+	strategyCache.mx.RLock()
+	s, ok := strategyCache.m[strategy]
+	strategyCache.mx.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	s, err := algeneva.NewHTTPStrategy(strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	strategyCache.mx.Lock()
+	if len(strategyCache.m) < maxCachedStrategies {
+		strategyCache.m[strategy] = s
+	}
+	strategyCache.mx.Unlock()
+	return s, nil
+}
+
+// triggerFieldRegexp matches the target field of a geneva rule's trigger, e.g. "method" in
+// "[HTTP:method:*]".
+var triggerFieldRegexp = regexp.MustCompile(`\[[^:\]]*:([^:\]]*):[^\]]*\]`)
+
+// requestLineOnly reports whether every rule in strategy targets a request-line field (method,
+// path, or version), meaning the strategy never modifies the headers.
+func requestLineOnly(strategy string) bool {
+	matches := triggerFieldRegexp.FindAllStringSubmatch(strategy, -1)
+	if len(matches) == 0 {
+		return false
+	}
+
+	for _, m := range matches {
+		switch strings.ToLower(m[1]) {
+		case "method", "path", "version":
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// ConnStrategy returns the geneva strategy that was applied to the connect request of c, a
+// connection returned by DialContext, through any of the wrapping added by DialerOpts, such as TLS.
+// This tells which strategy was picked from DialerOpts.AlgenevaStrategies or
+// DialerOpts.FallbackStrategies. ok is false if c wasn't dialed with a strategy.
+func ConnStrategy(c net.Conn) (strategy string, ok bool) {
+	for ; c != nil; c = unwrapConn(c) {
+		if htc, isHTC := c.(*httpTransformConn); isHTC {
+			return htc.strategy, htc.strategy != ""
+		}
+	}
+
+	return "", false
+}
+
+// StrategySelector picks the strategy each dial uses from DialerOpts.AlgenevaStrategies. A
+// StrategySelector is shared by all dials using the same DialerOpts, so it must be safe for
+// concurrent use.
+type StrategySelector interface {
+	// Select returns the index, in [0, n), of the strategy to use for the next dial.
+	Select(n int) int
+}
+
+// NewRoundRobinSelector returns a StrategySelector that cycles through the strategies in order.
+func NewRoundRobinSelector() StrategySelector {
+	return &roundRobinSelector{}
+}
+
+type roundRobinSelector struct {
+	next atomic.Uint64
+}
+
+// Select implements StrategySelector.
+func (s *roundRobinSelector) Select(n int) int {
+	return int((s.next.Add(1) - 1) % uint64(n))
+}
+
+// RandomSelector is a StrategySelector that picks a strategy at random for each dial. It's the
+// default if DialerOpts.StrategySelector is nil, in which case it draws from DialerOpts.Rand.
+type RandomSelector struct {
+	// Rand is the source of randomness. If nil, crypto/rand.Reader is used. It must be safe for
+	// concurrent use if the selector is shared between dials.
+	Rand io.Reader
+}
+
+// Select implements StrategySelector. If s.Rand fails, the strategy is picked with math/rand
+// instead so the dial can still go ahead.
+func (s RandomSelector) Select(n int) int {
+	r := s.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return mrand.Intn(n)
+	}
+
+	return int(binary.BigEndian.Uint64(b[:]) % uint64(n))
+}
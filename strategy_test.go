@@ -0,0 +1,302 @@
+package genevahttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/algeneva"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStrategyInfo(t *testing.T) {
+	raw := testStrategy(t, "China", 17)
+	info := NewStrategyInfo(raw)
+	assert.Equal(t, raw, info.String())
+
+	now := time.Now().UTC().Truncate(time.Second)
+	info.Region = "China"
+	info.Description = "replace the method with HTTP/1.1"
+	info.RecordSuccess(now.Add(-time.Minute))
+	info.RecordSuccess(now)
+	assert.Equal(t, 2, info.SuccessCount)
+	assert.Equal(t, now, info.LastSuccess)
+
+	b, err := json.Marshal(info)
+	require.NoError(t, err)
+
+	var got StrategyInfo
+	require.NoError(t, json.Unmarshal(b, &got))
+	assert.Equal(t, info, got)
+}
+
+func TestRegionStrategies(t *testing.T) {
+	infos := RegionStrategies("China")
+	require.Len(t, infos, len(algeneva.Strategies["China"]))
+	for i, info := range infos {
+		assert.Equal(t, algeneva.Strategies["China"][i], info.Strategy)
+		assert.Equal(t, "China", info.Region)
+	}
+
+	assert.Nil(t, RegionStrategies("Atlantis"))
+}
+
+func TestRequestLineOnly(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     bool
+	}{
+		{strategy: "[HTTP:method:*]-replace{HTTP/1.1:value:1}-|", want: true},
+		{strategy: "[HTTP:path:*]-insert{%20:start:value:1}-|[HTTP:version:*]-insert{%09:middle:value:14}-|", want: true},
+		{strategy: "[HTTP:host:*]-insert{%20:start:name:1}-|", want: false},
+		{strategy: "[HTTP:path:*]-insert{%20:start:value:1}-|[HTTP:host:*]-duplicate(replace{a:name:64},)-|", want: false},
+		{strategy: "", want: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, requestLineOnly(tt.strategy), tt.strategy)
+	}
+}
+
+// testStrategy returns the strategy at index for region, failing the test if it doesn't exist.
+func testStrategy(tb testing.TB, region string, index int) string {
+	tb.Helper()
+	s, err := Strategy(region, index)
+	require.NoError(tb, err)
+	return s
+}
+
+func TestStrategy(t *testing.T) {
+	s, err := Strategy("China", 0)
+	require.NoError(t, err)
+	assert.Equal(t, algeneva.Strategies["China"][0], s)
+
+	_, err = Strategy("China", len(algeneva.Strategies["China"]))
+	assert.ErrorIs(t, err, ErrStrategyNotFound)
+
+	_, err = Strategy("China", -1)
+	assert.ErrorIs(t, err, ErrStrategyNotFound)
+
+	_, err = Strategy("Atlantis", 0)
+	assert.ErrorIs(t, err, ErrStrategyNotFound)
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	s := NewRoundRobinSelector()
+	var got []int
+	for i := 0; i < 7; i++ {
+		got = append(got, s.Select(3))
+	}
+	assert.Equal(t, []int{0, 1, 2, 0, 1, 2, 0}, got)
+}
+
+func TestRandomSelector(t *testing.T) {
+	// Each selection reads a big-endian uint64 from Rand and takes it modulo n.
+	var b []byte
+	for _, v := range []uint64{0, 4, 5, 1<<63 + 2} {
+		b = binary.BigEndian.AppendUint64(b, v)
+	}
+	s := RandomSelector{Rand: bytes.NewReader(b)}
+	var got []int
+	for i := 0; i < 4; i++ {
+		got = append(got, s.Select(3))
+	}
+	assert.Equal(t, []int{0, 1, 2, 1}, got)
+
+	// Once Rand is exhausted it falls back to math/rand.
+	assert.Less(t, s.Select(3), 3)
+}
+
+func TestDialContextRandomSelectorUsesRand(t *testing.T) {
+	strategies := []string{
+		testStrategy(t, "China", 9),
+		testStrategy(t, "China", 17),
+		testStrategy(t, "Kazakhstan", 0),
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	var used []string
+	opts := DialerOpts{
+		AlgenevaStrategies: strategies,
+		WSTransport:        &stubTransport{conn: client},
+		Rand:               bytes.NewReader(binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, 2), 1)),
+		OnOutcome: func(_ context.Context, strategy string, err error) {
+			require.NoError(t, err)
+			used = append(used, strategy)
+		},
+		OutcomeOnHandshake: true,
+	}
+	for i := 0; i < 2; i++ {
+		_, err := DialContext(context.Background(), "tcp", "example.com:80", opts)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{strategies[2], strategies[1]}, used)
+}
+
+func TestDialContextAlgenevaStrategies(t *testing.T) {
+	strategies := []string{
+		testStrategy(t, "China", 9),
+		testStrategy(t, "China", 17),
+		testStrategy(t, "Kazakhstan", 0),
+	}
+	selectors := map[string]StrategySelector{
+		"round robin": NewRoundRobinSelector(),
+		"random":      nil,
+	}
+	for name, selector := range selectors {
+		t.Run(name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+
+			used := map[string]int{}
+			opts := DialerOpts{
+				AlgenevaStrategies: strategies,
+				StrategySelector:   selector,
+				WSTransport:        &stubTransport{conn: client},
+				OnOutcome: func(_ context.Context, strategy string, err error) {
+					require.NoError(t, err)
+					used[strategy]++
+				},
+				OutcomeOnHandshake: true,
+			}
+			for i := 0; i < 100; i++ {
+				_, err := DialContext(context.Background(), "tcp", "example.com:80", opts)
+				require.NoError(t, err)
+			}
+
+			assert.Len(t, used, len(strategies), "all strategies should be used")
+			for _, s := range strategies {
+				assert.NotZero(t, used[s], s)
+			}
+		})
+	}
+}
+
+func TestCompileStrategy(t *testing.T) {
+	raw := testStrategy(t, "China", 17)
+	s1, err := compileStrategy(raw)
+	require.NoError(t, err)
+	s2, err := compileStrategy(raw)
+	require.NoError(t, err)
+	assert.Same(t, s1, s2, "compiled strategy should be reused")
+
+	_, err = compileStrategy("not a strategy")
+	assert.Error(t, err)
+}
+
+func TestCompileStrategyConcurrentApply(t *testing.T) {
+	// Compiled strategies are shared between connections, so Apply must be safe for concurrent use.
+	// Run with -race to verify.
+	s, err := compileStrategy(testStrategy(t, "China", 9))
+	require.NoError(t, err)
+
+	want, err := s.Apply([]byte(testRequest))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				got, err := s.Apply([]byte(testRequest))
+				assert.NoError(t, err)
+				assert.Equal(t, want, got)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkCompileStrategy(b *testing.B) {
+	raw := testStrategy(b, "China", 17)
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := algeneva.NewHTTPStrategy(raw); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := compileStrategy(raw); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestConnStrategy(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer ll.Close()
+
+	go func() {
+		for {
+			c, err := ll.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	rootCertPool := x509.NewCertPool()
+	require.True(t, rootCertPool.AppendCertsFromPEM([]byte(certPEM)))
+
+	strategies := []string{testStrategy(t, "China", 9), testStrategy(t, "China", 17)}
+	opts := DialerOpts{
+		AlgenevaStrategies: strategies,
+		StrategySelector:   NewRoundRobinSelector(),
+		TLSConfig:          &tls.Config{RootCAs: rootCertPool, ServerName: "localhost"},
+		WriteChunkSize:     1024,
+		MaxConnLifetime:    time.Hour,
+		OnOutcome:          func(context.Context, string, error) {},
+	}
+	for _, want := range strategies {
+		c, err := DialContext(context.Background(), "tcp", l.Addr().String(), opts)
+		require.NoError(t, err)
+
+		got, ok := ConnStrategy(c)
+		assert.True(t, ok)
+		assert.Equal(t, want, got)
+		transformed, ok := TransformedFirstRequest(c)
+		assert.True(t, ok)
+		assert.True(t, transformed)
+		c.Close()
+	}
+
+	c, err := DialContext(context.Background(), "tcp", l.Addr().String(), DialerOpts{})
+	require.NoError(t, err)
+	defer c.Close()
+	_, ok := ConnStrategy(c)
+	assert.False(t, ok, "connection dialed without a strategy")
+	_, ok = TransformedFirstRequest(c)
+	assert.False(t, ok, "connection dialed without a strategy")
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	_, ok = ConnStrategy(c1)
+	assert.False(t, ok, "connection not dialed by this package")
+}
@@ -0,0 +1,53 @@
+package genevahttp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrNoSyscallConn is returned by SyscallConn if the connection isn't backed by a connection that
+// supports syscall.Conn, e.g. a net.Pipe.
+var ErrNoSyscallConn = errors.New("connection does not support syscall.Conn")
+
+// SyscallConn returns the syscall.RawConn of the base connection underlying c, such as the
+// *net.TCPConn dialed by DialContext or accepted by WrapListener, for low-level socket operations
+// like setting socket marks. c may be any connection returned by this package. Note that reading
+// from or writing to the raw connection directly will corrupt the websocket stream.
+func SyscallConn(c net.Conn) (syscall.RawConn, error) {
+	for ; c != nil; c = unwrapConn(c) {
+		if sc, ok := c.(syscall.Conn); ok {
+			return sc.SyscallConn()
+		}
+	}
+
+	return nil, ErrNoSyscallConn
+}
+
+// unwrapConn returns the connection wrapped by c, or nil if c isn't one of this package's wrappers
+// or the wrapped connection isn't known.
+func unwrapConn(c net.Conn) net.Conn {
+	switch cc := c.(type) {
+	case *tls.Conn:
+		return cc.NetConn()
+	case *nhooyrConn:
+		return cc.NetConn()
+	case *httpTransformConn:
+		return cc.Conn
+	case *normalizationConn:
+		return cc.Conn
+	case *chunkedConn:
+		return cc.Conn
+	case *lifetimeConn:
+		return cc.Conn
+	case *boundConn:
+		return cc.Conn
+	case *outcomeConn:
+		return cc.Conn
+	case *jitterConn:
+		return cc.Conn
+	default:
+		return nil
+	}
+}
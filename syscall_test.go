@@ -0,0 +1,53 @@
+package genevahttp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyscallConn(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ll.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	c, err := Dial("tcp", l.Addr().String(), DialerOpts{WriteChunkSize: 1024})
+	require.NoError(t, err)
+
+	sc := <-accepted
+	// Close both ends at once, since closing a websocket waits for the peer to respond.
+	defer func() {
+		go sc.Close()
+		c.Close()
+	}()
+
+	for name, conn := range map[string]net.Conn{"client": c, "server": sc} {
+		rc, err := SyscallConn(conn)
+		require.NoError(t, err, name)
+
+		var fd uintptr
+		require.NoError(t, rc.Control(func(f uintptr) { fd = f }), name)
+		assert.NotZero(t, fd, name)
+	}
+}
+
+func TestSyscallConnPipe(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	_, err := SyscallConn(&httpTransformConn{Conn: c1})
+	assert.ErrorIs(t, err, ErrNoSyscallConn)
+}
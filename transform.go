@@ -0,0 +1,210 @@
+package genevahttp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/getlantern/algeneva"
+)
+
+// ErrInvalidStrategy is returned by ValidateStrategy if a strategy can't be used to tunnel.
+var ErrInvalidStrategy = errors.New("invalid geneva strategy")
+
+// validationRequest is the sample request ValidateStrategy round-trips. It resembles the websocket
+// upgrade request sent by the dialer.
+const validationRequest = "GET / HTTP/1.1\r\n" +
+	"Host: example.com\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n\r\n"
+
+// TransformRequest applies the geneva strategy to request and returns the transformed bytes,
+// without a connection. It's useful for testing a strategy or building a custom transport.
+// request must be a complete HTTP request head. As with the dialer, a strategy that panics while
+// being applied results in an error.
+func TransformRequest(strategy string, request []byte) ([]byte, error) {
+	s, err := compileStrategy(strategy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create geneva strategy: %w", err)
+	}
+
+	transformed, err := applyStrategy(s, request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transform request: %w", err)
+	}
+
+	return transformed, nil
+}
+
+// NormalizeRequestBytes is the inverse of TransformRequest. It returns transformed normalized back
+// into a valid HTTP request, as the listener does for the first request on a connection. An error
+// wrapping ErrEmptyNormalization is returned if normalizing produces no data.
+func NormalizeRequestBytes(transformed []byte) ([]byte, error) {
+	norm, err := normalizeRequest(transformed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize request: %w", err)
+	}
+
+	if len(norm) == 0 {
+		return nil, fmt.Errorf("failed to normalize request: %w", ErrEmptyNormalization)
+	}
+
+	return norm, nil
+}
+
+// ValidateStrategy checks that strategy can be used to tunnel without dialing. It compiles the
+// strategy, applies it to a sample request, normalizes the result as the listener would, and
+// checks that the listener's HTTP server would accept the recovered request, so strategies that
+// produce unrecoverable requests are caught before they're deployed. It's meant for user-supplied
+// strategies, so it never panics. The returned error wraps ErrInvalidStrategy and names the stage
+// that failed: compile, apply, normalize, or parse.
+func ValidateStrategy(strategy string) error {
+	s, err := algeneva.NewHTTPStrategy(strategy)
+	if err != nil {
+		return fmt.Errorf("%w: compile: %w", ErrInvalidStrategy, err)
+	}
+
+	if _, err := roundTripRequest(s, []byte(validationRequest)); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidStrategy, err)
+	}
+
+	return nil
+}
+
+// StrategyResult is the outcome of round-tripping sample requests through one of the built-in
+// strategies. See TestAllStrategies.
+type StrategyResult struct {
+	// Region and Index identify the strategy in algeneva.Strategies.
+	Region string
+	Index  int
+	// Strategy is the strategy string.
+	Strategy string
+	// Passed reports whether every request was recovered.
+	Passed bool
+	// Diff describes the first failure if Passed is false: the stage that failed, or the first
+	// difference between a request and its recovered form.
+	Diff string
+}
+
+// TestAllStrategies applies every strategy in algeneva.Strategies to each of requests, normalizes
+// the result as the listener would, and checks that the recovered request matches the original in
+// method, request-URI, Host, and headers. It helps maintainers spot strategies that break
+// normalization. Header names are compared canonicalized, since normalization may change their
+// case. Results are sorted by region and index, so the output is deterministic and can be
+// compared across runs, e.g. in CI.
+func TestAllStrategies(requests [][]byte) []StrategyResult {
+	regions := make([]string, 0, len(algeneva.Strategies))
+	for region := range algeneva.Strategies {
+		regions = append(regions, region)
+	}
+	slices.Sort(regions)
+
+	var results []StrategyResult
+	for _, region := range regions {
+		for i, strategy := range algeneva.Strategies[region] {
+			res := StrategyResult{Region: region, Index: i, Strategy: strategy}
+			res.Diff = checkStrategy(strategy, requests)
+			res.Passed = res.Diff == ""
+			results = append(results, res)
+		}
+	}
+
+	return results
+}
+
+// checkStrategy round-trips each of requests through strategy and returns a description of the
+// first failure, or an empty string if every request was recovered.
+func checkStrategy(strategy string, requests [][]byte) string {
+	s, err := compileStrategy(strategy)
+	if err != nil {
+		return fmt.Sprintf("compile: %v", err)
+	}
+
+	for i, req := range requests {
+		want, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req)))
+		if err != nil {
+			return fmt.Sprintf("request %d: invalid sample request: %v", i, err)
+		}
+
+		got, err := roundTripRequest(s, req)
+		if err != nil {
+			return fmt.Sprintf("request %d: %v", i, err)
+		}
+
+		if diff := requestDiff(want, got); diff != "" {
+			return fmt.Sprintf("request %d: %s", i, diff)
+		}
+	}
+
+	return ""
+}
+
+// roundTripRequest applies s to req, normalizes the result, and parses the normalized request. The
+// returned error names the stage that failed: apply, normalize, or parse.
+func roundTripRequest(s *algeneva.HTTPStrategy, req []byte) (*http.Request, error) {
+	transformed, err := applyStrategy(s, req)
+	if err != nil {
+		return nil, fmt.Errorf("apply: %w", err)
+	}
+
+	norm, err := NormalizeRequestBytes(transformed)
+	if err != nil {
+		return nil, fmt.Errorf("normalize: %w", err)
+	}
+
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(norm)))
+	if err != nil {
+		return nil, fmt.Errorf("parse: normalized request %q is malformed: %w", norm, err)
+	}
+
+	return r, nil
+}
+
+// requestDiff returns a description of the first difference between want and got in method,
+// request-URI, Host, or headers, or an empty string if there is none. Headers are compared in
+// sorted order.
+func requestDiff(want, got *http.Request) string {
+	switch {
+	case want.Method != got.Method:
+		return fmt.Sprintf("method: want %q, got %q", want.Method, got.Method)
+	case want.RequestURI != got.RequestURI:
+		return fmt.Sprintf("request-URI: want %q, got %q", want.RequestURI, got.RequestURI)
+	case want.Host != got.Host:
+		return fmt.Sprintf("Host: want %q, got %q", want.Host, got.Host)
+	}
+
+	keys := make([]string, 0, len(want.Header)+len(got.Header))
+	for k := range want.Header {
+		keys = append(keys, k)
+	}
+	for k := range got.Header {
+		if _, ok := want.Header[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		if w, g := want.Header[k], got.Header[k]; !slices.Equal(w, g) {
+			return fmt.Sprintf("header %q: want %q, got %q", k, w, g)
+		}
+	}
+
+	return ""
+}
+
+// applyStrategy applies s to req, recovering from any panic in the strategy.
+func applyStrategy(s *algeneva.HTTPStrategy, req []byte) (transformed []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic applying strategy: %v", r)
+		}
+	}()
+
+	return s.Apply(req)
+}
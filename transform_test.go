@@ -0,0 +1,140 @@
+package genevahttp
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/algeneva"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransformRequestRoundTrip(t *testing.T) {
+	req := "GET /path HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n"
+	transformed, err := TransformRequest(testStrategy(t, "China", 17), []byte(req))
+	require.NoError(t, err)
+	assert.NotEqual(t, req, string(transformed), "request should be transformed")
+
+	norm, err := NormalizeRequestBytes(transformed)
+	require.NoError(t, err)
+
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(norm)))
+	require.NoError(t, err, "normalized request should be valid")
+	assert.Equal(t, http.MethodGet, r.Method)
+	assert.Equal(t, "/path", r.URL.Path)
+	assert.Equal(t, "example.com", r.Host)
+	assert.Equal(t, "websocket", r.Header.Get("Upgrade"))
+}
+
+func TestTransformRequestInvalidStrategy(t *testing.T) {
+	_, err := TransformRequest("not a strategy", []byte("GET / HTTP/1.1\r\n\r\n"))
+	assert.ErrorContains(t, err, "failed to create geneva strategy")
+}
+
+func TestTransformRequestPanic(t *testing.T) {
+	// Non-ASCII header values throw off algeneva's header lookup, making Apply panic.
+	req := "GET / HTTP/1.1\r\nX: " + strings.Repeat("\u0130", 10) + "\r\nHost: example.com\r\n\r\n"
+
+	var err error
+	require.NotPanics(t, func() {
+		_, err = TransformRequest("[HTTP:host:*]-changecase{upper}-|", []byte(req))
+	})
+	assert.ErrorContains(t, err, "panic applying strategy")
+}
+
+func TestNormalizeRequestBytesEmpty(t *testing.T) {
+	_, err := NormalizeRequestBytes(nil)
+	assert.Error(t, err)
+
+	_, err = NormalizeRequestBytes([]byte(strings.Repeat("\r\n", 2)))
+	assert.Error(t, err)
+}
+
+func TestValidateStrategy(t *testing.T) {
+	assert.NoError(t, ValidateStrategy(testStrategy(t, "China", 17)))
+
+	tests := []struct {
+		name     string
+		strategy string
+		stage    string
+	}{
+		{name: "malformed", strategy: "not a strategy", stage: "compile"},
+		// Replacing the request-line with CRLF leaves nothing to normalize.
+		{name: "unrecoverable", strategy: "[HTTP:method:*]-replace{%0D%0A:value:1}-|", stage: "normalize"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateStrategy(tt.strategy)
+			assert.ErrorIs(t, err, ErrInvalidStrategy)
+			assert.ErrorContains(t, err, ": "+tt.stage+": ")
+		})
+	}
+}
+
+func TestTestAllStrategies(t *testing.T) {
+	requests := [][]byte{[]byte(validationRequest)}
+	results := TestAllStrategies(requests)
+
+	var total int
+	for _, strategies := range algeneva.Strategies {
+		total += len(strategies)
+	}
+	require.Len(t, results, total)
+	assert.Equal(t, results, TestAllStrategies(requests), "results should be deterministic")
+	assert.True(t, slices.IsSortedFunc(results, func(a, b StrategyResult) int {
+		if c := cmp.Compare(a.Region, b.Region); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Index, b.Index)
+	}))
+
+	result := func(results []StrategyResult, region string, index int) StrategyResult {
+		i := slices.IndexFunc(results, func(r StrategyResult) bool {
+			return r.Region == region && r.Index == index
+		})
+		require.GreaterOrEqual(t, i, 0)
+		return results[i]
+	}
+
+	passed := result(results, "China", 17)
+	assert.True(t, passed.Passed)
+	assert.Empty(t, passed.Diff)
+
+	// The strategy leaves a header without a name, which the listener's HTTP server rejects.
+	failed := result(results, "China", 3)
+	assert.False(t, failed.Passed)
+	assert.Contains(t, failed.Diff, "request 0: parse: ")
+
+	// Normalization doesn't recover the query string's delimiters, which is reported against the
+	// request that exposed it.
+	results = TestAllStrategies(append(requests, []byte("GET /path?id=1 HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+	assert.Equal(t, `request 1: request-URI: want "/path?id=1", got "/pathid1"`, result(results, "China", 17).Diff)
+
+	for _, r := range TestAllStrategies([][]byte{[]byte("not a request")}) {
+		assert.Contains(t, r.Diff, "invalid sample request")
+	}
+}
+
+func TestRequestDiff(t *testing.T) {
+	parse := func(req string) *http.Request {
+		r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(req)))
+		require.NoError(t, err)
+		return r
+	}
+
+	want := parse("GET /a HTTP/1.1\r\nHost: example.com\r\nX-A: 1\r\nX-B: 2\r\n\r\n")
+	assert.Empty(t, requestDiff(want, parse("GET /a HTTP/1.1\r\nhost: example.com\r\nx-a: 1\r\nX-B: 2\r\n\r\n")))
+	assert.Equal(t, `method: want "GET", got "POST"`,
+		requestDiff(want, parse("POST /a HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+	assert.Equal(t, `request-URI: want "/a", got "/b"`,
+		requestDiff(want, parse("GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+	assert.Equal(t, `header "X-A": want ["1"], got ["3"]`,
+		requestDiff(want, parse("GET /a HTTP/1.1\r\nHost: example.com\r\nX-A: 3\r\nX-C: 4\r\n\r\n")))
+	assert.Equal(t, `header "X-C": want [], got ["4"]`,
+		requestDiff(want, parse("GET /a HTTP/1.1\r\nHost: example.com\r\nX-A: 1\r\nX-B: 2\r\nX-C: 4\r\n\r\n")))
+}
@@ -0,0 +1,208 @@
+package genevahttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// WSTransport establishes websocket connections and converts them to a net.Conn. It allows the
+// websocket implementation to be swapped out, e.g. to change the fingerprint of the handshake.
+type WSTransport interface {
+	// Dial performs a websocket handshake with the server at url, sending the upgrade request with
+	// client, and returns the resulting connection. If the server responds without upgrading, Dial
+	// should return a *DialError.
+	Dial(ctx context.Context, url string, client *http.Client) (net.Conn, error)
+	// Accept accepts a websocket handshake from a client and returns the resulting connection.
+	Accept(w http.ResponseWriter, r *http.Request) (net.Conn, error)
+}
+
+// ErrServerBusy is returned when reading from a connection the server closed because it was too
+// busy to accept it. Clients should back off and retry or fall back to another server.
+var ErrServerBusy = errors.New("server busy")
+
+// maxDialErrorBody is the maximum number of bytes of the response body kept in a DialError.
+const maxDialErrorBody = 512
+
+// DialError is returned when the server responds to the websocket upgrade request with something
+// other than a successful upgrade. Censors often respond with a block page, so the status code
+// and the start of the body help tell active blocking apart from network failures.
+type DialError struct {
+	// StatusCode is the status code of the response.
+	StatusCode int
+	// BodySnippet holds up to the first 512 bytes of the response body.
+	BodySnippet []byte
+	// Err is the error returned by the websocket implementation.
+	Err error
+}
+
+func (e *DialError) Error() string {
+	return "websocket upgrade failed with status " + strconv.Itoa(e.StatusCode) + ": " + e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error { return e.Err }
+
+// newDialError returns a DialError for a failed upgrade with the response resp, reading at most
+// maxDialErrorBody bytes of its body. The body is closed.
+func newDialError(resp *http.Response, err error) *DialError {
+	de := &DialError{StatusCode: resp.StatusCode, Err: err}
+	if resp.Body != nil {
+		de.BodySnippet, _ = io.ReadAll(io.LimitReader(resp.Body, maxDialErrorBody))
+		resp.Body.Close()
+	}
+
+	return de
+}
+
+// busyCloser is implemented by connections that can signal the peer that the server is busy when
+// closing. Connections returned by WSTransport.Accept may implement it; otherwise, busy connections
+// are closed normally.
+type busyCloser interface {
+	// CloseBusy closes the connection, telling the peer the server is too busy to accept it.
+	CloseBusy() error
+}
+
+// keepAliver is implemented by connections that can detect a dead peer by pinging it. Connections
+// returned by WSTransport may implement it; otherwise, keep-alives are not sent.
+type keepAliver interface {
+	// KeepAlive starts pinging the peer every interval, as measured by clk, in the background until
+	// the connection is closed. If the peer doesn't respond within interval, the connection is
+	// closed.
+	KeepAlive(interval time.Duration, clk clock)
+}
+
+// nhooyrTransport is a WSTransport backed by nhooyr.io/websocket. It's used if no WSTransport is
+// specified. Connections send and receive binary messages.
+type nhooyrTransport struct {
+	// compressionMode is the permessage-deflate mode offered or accepted in the handshake.
+	compressionMode websocket.CompressionMode
+}
+
+// Dial implements WSTransport.
+func (t nhooyrTransport) Dial(ctx context.Context, url string, client *http.Client) (net.Conn, error) {
+	wsc, resp, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPClient:      client,
+		CompressionMode: t.compressionMode,
+	})
+	if err != nil {
+		if resp != nil {
+			return nil, newDialError(resp, err)
+		}
+		return nil, err
+	}
+
+	return newNhooyrConn(wsc), nil
+}
+
+// Accept implements WSTransport.
+func (t nhooyrTransport) Accept(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	wsc, err := websocket.Accept(w, r, &websocket.AcceptOptions{CompressionMode: t.compressionMode})
+	if err != nil {
+		return nil, err
+	}
+
+	return newNhooyrConn(wsc), nil
+}
+
+// nhooyrConn is a net.Conn backed by a nhooyr.io/websocket connection. The server busy signal is
+// sent as a close frame with websocket.StatusTryAgainLater.
+type nhooyrConn struct {
+	net.Conn
+	wsc *websocket.Conn
+	// base is the connection the websocket runs over, if known.
+	base net.Conn
+
+	// mx guards keepAlive and closed.
+	mx sync.Mutex
+	// keepAlive, if not nil, schedules the next keep-alive ping.
+	keepAlive timer
+	// closed is set when the connection is closed, stopping keep-alives.
+	closed bool
+}
+
+func newNhooyrConn(wsc *websocket.Conn) *nhooyrConn {
+	return &nhooyrConn{
+		Conn: websocket.NetConn(context.Background(), wsc, websocket.MessageBinary),
+		wsc:  wsc,
+	}
+}
+
+// Close implements net.Conn.
+func (c *nhooyrConn) Close() error {
+	c.stopKeepAlive()
+	return c.Conn.Close()
+}
+
+// stopKeepAlive marks c as closed and stops any scheduled keep-alive ping.
+func (c *nhooyrConn) stopKeepAlive() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.closed = true
+	if c.keepAlive != nil {
+		c.keepAlive.Stop()
+	}
+}
+
+// KeepAlive implements keepAliver. The pong is received by Read, so pings only succeed while the
+// connection is being read from; a connection nobody reads is treated as dead.
+func (c *nhooyrConn) KeepAlive(interval time.Duration, clk clock) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closed {
+		return
+	}
+
+	c.keepAlive = clk.AfterFunc(interval, func() { c.ping(interval, clk) })
+}
+
+// ping sends a keep-alive ping and schedules the next one once the pong arrives. If no pong
+// arrives within interval, the connection is closed.
+func (c *nhooyrConn) ping(interval time.Duration, clk clock) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pingTimer := clk.AfterFunc(interval, cancel)
+	err := c.wsc.Ping(ctx)
+	pingTimer.Stop()
+	cancel()
+	if err != nil {
+		// The peer is unresponsive, so don't wait on it for the close handshake.
+		c.stopKeepAlive()
+		c.wsc.CloseNow()
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if !c.closed {
+		c.keepAlive.Reset(interval)
+	}
+}
+
+// Read implements net.Conn. If the server closed the connection because it was busy, Read returns
+// an error wrapping ErrServerBusy.
+func (c *nhooyrConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if websocket.CloseStatus(err) == websocket.StatusTryAgainLater {
+		err = fmt.Errorf("%w: %w", ErrServerBusy, err)
+	}
+
+	return n, err
+}
+
+// CloseBusy implements busyCloser.
+func (c *nhooyrConn) CloseBusy() error {
+	c.stopKeepAlive()
+	return c.wsc.Close(websocket.StatusTryAgainLater, "server busy")
+}
+
+// NetConn returns the connection the websocket runs over, or nil if it isn't known.
+func (c *nhooyrConn) NetConn() net.Conn {
+	return c.base
+}
@@ -0,0 +1,234 @@
+package genevahttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"nhooyr.io/websocket"
+)
+
+func TestNhooyrTransportNormalCloseIsEOF(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ll.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	c, err := Dial("tcp", l.Addr().String(), DialerOpts{})
+	require.NoError(t, err)
+	defer c.Close()
+
+	sc := <-accepted
+	closed := make(chan error, 1)
+	go func() { closed <- sc.Close() }()
+
+	// Each side should see a normal close as io.EOF, like a plain net.Conn.
+	_, err = c.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, <-closed)
+}
+
+func TestDialErrorBlockPage(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	// A censor answering the upgrade request with a block page.
+	page := strings.Repeat("blocked ", 200)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, page)
+	})}
+	go srv.Serve(&innerListener{Listener: l})
+	defer srv.Close()
+
+	_, err = Dial("tcp", l.Addr().String(), DialerOpts{})
+	var de *DialError
+	require.ErrorAs(t, err, &de)
+	assert.Equal(t, http.StatusForbidden, de.StatusCode)
+	assert.Equal(t, page[:maxDialErrorBody], string(de.BodySnippet))
+	assert.Contains(t, err.Error(), "status 403")
+}
+
+func TestKeepAlive(t *testing.T) {
+	const interval = 100 * time.Millisecond
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListenerWithOpts(l, WrapListenerOpts{KeepAlive: interval})
+	defer ll.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			c, err := ll.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	t.Run("responsive peer", func(t *testing.T) {
+		c, err := Dial("tcp", l.Addr().String(), DialerOpts{KeepAlive: interval})
+		require.NoError(t, err)
+		defer c.Close()
+
+		sc := <-accepted
+		defer func() { go sc.Close() }()
+
+		// Both sides keep a read pending, so pongs are received and the connection outlives several
+		// intervals.
+		read := make(chan error, 1)
+		go func() {
+			_, err := sc.Read(make([]byte, 4))
+			read <- err
+		}()
+		go c.Read(make([]byte, 1))
+
+		time.Sleep(5 * interval)
+		_, err = c.Write([]byte("ping"))
+		require.NoError(t, err)
+		assert.NoError(t, <-read)
+	})
+
+	t.Run("stalled peer", func(t *testing.T) {
+		// The client never reads, so it never answers the server's pings.
+		c, err := Dial("tcp", l.Addr().String(), DialerOpts{})
+		require.NoError(t, err)
+		// Closing waits for the close handshake, which the dead server can't complete.
+		defer func() { go c.Close() }()
+
+		sc := <-accepted
+		defer sc.Close()
+
+		start := time.Now()
+		_, err = sc.Read(make([]byte, 1))
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), 10*interval, "dead connection should be closed promptly")
+	})
+}
+
+func TestKeepAliveClock(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	clk := newFakeClock()
+	ll, _ := WrapListenerWithOpts(l, WrapListenerOpts{KeepAlive: time.Minute, clock: clk})
+	defer ll.Close()
+	go func() {
+		if sc, err := ll.Accept(); err == nil {
+			sc.Read(make([]byte, 1))
+			sc.Close()
+		}
+	}()
+
+	// The client never reads, so it never answers the server's ping.
+	c, err := Dial("tcp", l.Addr().String(), DialerOpts{})
+	require.NoError(t, err)
+	defer func() { go c.Close() }()
+
+	// The first timer schedules the ping, the second times it out.
+	clk.waitForTimers(1)
+	clk.Advance(time.Minute)
+	clk.waitForTimers(1)
+	clk.Advance(time.Minute)
+
+	_, err = c.Read(make([]byte, 1))
+	assert.Error(t, err, "server should close the connection once the ping times out")
+}
+
+func TestNhooyrTransportCompressionMode(t *testing.T) {
+	modes := map[string]websocket.CompressionMode{
+		"disabled":            websocket.CompressionDisabled,
+		"no context takeover": websocket.CompressionNoContextTakeover,
+		"context takeover":    websocket.CompressionContextTakeover,
+	}
+	for name, mode := range modes {
+		t.Run(name, func(t *testing.T) {
+			transport := nhooyrTransport{compressionMode: mode}
+
+			offered := make(chan string, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				offered <- r.Header.Get("Sec-WebSocket-Extensions")
+				c, err := transport.Accept(w, r)
+				if err == nil {
+					c.Close()
+				}
+			}))
+			defer srv.Close()
+
+			// The server should only negotiate the extension if it's enabled.
+			wsc, resp, err := websocket.Dial(context.Background(), srv.URL, &websocket.DialOptions{
+				CompressionMode: websocket.CompressionContextTakeover,
+			})
+			require.NoError(t, err)
+			go wsc.CloseNow()
+			<-offered
+			negotiated := resp.Header.Get("Sec-WebSocket-Extensions")
+
+			// The client should only offer the extension if it's enabled.
+			c, err := transport.Dial(context.Background(), srv.URL, srv.Client())
+			require.NoError(t, err)
+			go c.Close()
+
+			if mode == websocket.CompressionDisabled {
+				assert.Empty(t, <-offered)
+				assert.Empty(t, negotiated)
+			} else {
+				assert.Contains(t, <-offered, "permessage-deflate")
+				assert.Contains(t, negotiated, "permessage-deflate")
+			}
+		})
+	}
+}
+
+func TestNhooyrTransportLargeMessage(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	defer ll.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ll.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	c, err := Dial("tcp", l.Addr().String(), DialerOpts{})
+	require.NoError(t, err)
+	defer c.Close()
+
+	sc := <-accepted
+	defer func() { go sc.Close() }()
+
+	// Each write is sent as a single message, well over the library's default read limit of 32KiB,
+	// which websocket.NetConn lifts.
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	go c.Write(payload)
+
+	got := make([]byte, len(payload))
+	_, err = io.ReadFull(sc, got)
+	require.NoError(t, err)
+	assert.Equal(t, payload, got)
+}
@@ -0,0 +1,210 @@
+package genevahttp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// The local proxies started by ServeSOCKS5 and ServeHTTPProxy reach arbitrary hosts by tunneling
+// through a geneva server. After the handshake, the client sends the address it wants to reach as
+// a big-endian uint16 length followed by the address. The server dials it and answers with a single
+// status byte, tunnelStatusOK or tunnelStatusFailed. Data is then relayed in frames, see
+// tunnelConn.
+const (
+	tunnelStatusOK     = 0x00
+	tunnelStatusFailed = 0x01
+
+	// tunnelFrameData is followed by a big-endian uint32 length and that many bytes of data.
+	tunnelFrameData = 0x00
+	// tunnelFrameCloseWrite signals that the sender won't send any more data.
+	tunnelFrameCloseWrite = 0x01
+
+	// tunnelDialTimeout bounds dialing the tunnel and the target address, including the status
+	// exchange.
+	tunnelDialTimeout = 30 * time.Second
+)
+
+// ErrTunnelDialFailed is returned by the local proxies when the geneva server couldn't reach the
+// requested address.
+var ErrTunnelDialFailed = errors.New("server failed to dial target")
+
+// dialTunnel dials the geneva server at serverAddr with opts and asks it to connect to target. The
+// returned connection relays data to and from target.
+func dialTunnel(ctx context.Context, serverAddr, target string, opts DialerOpts) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, tunnelDialTimeout)
+	defer cancel()
+
+	c, err := DialContext(ctx, "tcp", serverAddr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// DialContext is done with ctx, so bound the status exchange with a deadline instead.
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if err := writeTunnelTarget(c, target); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	var status [1]byte
+	if _, err := io.ReadFull(c, status[:]); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("reading tunnel status: %w", err)
+	}
+	if status[0] != tunnelStatusOK {
+		c.Close()
+		return nil, fmt.Errorf("%w: %s", ErrTunnelDialFailed, target)
+	}
+
+	c.SetDeadline(time.Time{})
+	return &tunnelConn{Conn: c}, nil
+}
+
+// ServeTunnel serves the clients of the local proxies started by ServeSOCKS5 and ServeHTTPProxy.
+// l is normally a listener returned by WrapListener. For each connection, ServeTunnel reads the
+// address the client asked for, dials it with dialer, and copies data in both directions until
+// either side closes. If dialer is nil, a net.Dialer is used. ServeTunnel blocks until accepting a
+// connection fails.
+func ServeTunnel(l net.Listener, dialer Dialer) error {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go handleTunnel(c, dialer)
+	}
+}
+
+// handleTunnel reads the target address from c, dials it with dialer, and splices the two
+// connections together.
+func handleTunnel(c net.Conn, dialer Dialer) {
+	c.SetReadDeadline(time.Now().Add(tunnelDialTimeout))
+	target, err := readTunnelTarget(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), tunnelDialTimeout)
+	up, err := dialer.DialContext(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		c.Write([]byte{tunnelStatusFailed})
+		c.Close()
+		return
+	}
+
+	if _, err := c.Write([]byte{tunnelStatusOK}); err != nil {
+		c.Close()
+		up.Close()
+		return
+	}
+
+	splice(&tunnelConn{Conn: c}, up)
+}
+
+// writeTunnelTarget writes target to c as a length-prefixed address.
+func writeTunnelTarget(c net.Conn, target string) error {
+	if len(target) > 0xffff {
+		return fmt.Errorf("target address too long: %d bytes", len(target))
+	}
+
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(target)))
+	_, err := c.Write(append(b, target...))
+	return err
+}
+
+// readTunnelTarget reads a length-prefixed address from c.
+func readTunnelTarget(c net.Conn) (string, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(c, n[:]); err != nil {
+		return "", err
+	}
+
+	target := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(c, target); err != nil {
+		return "", err
+	}
+
+	return string(target), nil
+}
+
+// tunnelConn frames the data relayed over a tunnel so either side can half-close it, which the
+// websocket connection underneath doesn't support. Each Write is sent as a data frame, and
+// CloseWrite sends a close-write frame, after which the peer's reads return io.EOF.
+type tunnelConn struct {
+	net.Conn
+	// remaining is the number of bytes left to read in the current data frame.
+	remaining uint32
+	// eof is set once the peer's close-write frame is read.
+	eof bool
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+
+		var typ [1]byte
+		if _, err := io.ReadFull(c.Conn, typ[:]); err != nil {
+			return 0, err
+		}
+		switch typ[0] {
+		case tunnelFrameData:
+			var n [4]byte
+			if _, err := io.ReadFull(c.Conn, n[:]); err != nil {
+				return 0, err
+			}
+			c.remaining = binary.BigEndian.Uint32(n[:])
+		case tunnelFrameCloseWrite:
+			c.eof = true
+		default:
+			return 0, fmt.Errorf("unknown tunnel frame type %d", typ[0])
+		}
+	}
+
+	if uint32(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.Conn.Read(b)
+	c.remaining -= uint32(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	frame := make([]byte, 5, 5+len(b))
+	frame[0] = tunnelFrameData
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(b)))
+	if _, err := c.Conn.Write(append(frame, b...)); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// CloseWrite tells the peer that no more data will be sent. The connection can still be read from.
+func (c *tunnelConn) CloseWrite() error {
+	_, err := c.Conn.Write([]byte{tunnelFrameCloseWrite})
+	return err
+}
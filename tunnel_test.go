@@ -0,0 +1,61 @@
+package genevahttp
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTunnelServer starts a geneva server running ServeTunnel and returns its address.
+func startTunnelServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ll, _ := WrapListener(l, nil)
+	t.Cleanup(func() { ll.Close() })
+
+	go ServeTunnel(ll, nil)
+	return l.Addr().String()
+}
+
+// closedAddr returns an address nothing is listening on.
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	l.Close()
+	return l.Addr().String()
+}
+
+func TestDialTunnel(t *testing.T) {
+	serverAddr := startTunnelServer(t)
+
+	target, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, target.Addr().String())
+	}()
+
+	c, err := dialTunnel(context.Background(), serverAddr, target.Addr().String(), DialerOpts{})
+	require.NoError(t, err)
+	defer func() { go c.Close() }()
+
+	got := make([]byte, len(target.Addr().String()))
+	_, err = io.ReadFull(c, got)
+	require.NoError(t, err)
+	assert.Equal(t, target.Addr().String(), string(got), "data should come from the requested target")
+	_, err = c.Read(make([]byte, 1))
+	assert.Error(t, err, "tunnel should be closed once the target closes")
+
+	_, err = dialTunnel(context.Background(), serverAddr, closedAddr(t), DialerOpts{})
+	assert.ErrorIs(t, err, ErrTunnelDialFailed)
+}